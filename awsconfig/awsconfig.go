@@ -0,0 +1,181 @@
+// Package awsconfig loads the AWS config that clients are created from, using a named profile,
+// region and endpoint overrides, e.g. to use LocalStack or DynamoDB Local in integration tests.
+package awsconfig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Service is a service whose endpoint can be overridden.
+type Service string
+
+const (
+	ServiceCloudWatch Service = "cloudwatch"
+	ServiceDynamoDB   Service = "dynamodb"
+	ServiceFirehose   Service = "firehose"
+	ServiceS3         Service = "s3"
+)
+
+// Services returns the services whose endpoints can be overridden, in alphabetical order.
+func Services() []Service {
+	return []Service{ServiceCloudWatch, ServiceDynamoDB, ServiceFirehose, ServiceS3}
+}
+
+func (svc Service) isValid() bool {
+	for _, s := range Services() {
+		if s == svc {
+			return true
+		}
+	}
+	return false
+}
+
+// Settings configure how the AWS config is loaded. The zero Settings load the default config.
+type Settings struct {
+	// Profile is the shared config profile to use, instead of the default.
+	Profile string
+	// Region to use, instead of the default region.
+	Region string
+	// EndpointURL is used for every service that doesn't have its own endpoint.
+	EndpointURL string
+	// Endpoints override the endpoint URL of each service.
+	Endpoints map[Service]string
+	// RetryMaxAttempts overrides the number of attempts the SDK makes for each call, if it isn't
+	// zero. Use 1 when the calls are retried by the caller, e.g. by the processor's retry policy.
+	RetryMaxAttempts int
+}
+
+// FromEnv returns settings with the endpoints set by the AWS_ENDPOINT_URL env variable, and the
+// AWS_ENDPOINT_URL_<SERVICE> env variable of each service, e.g. AWS_ENDPOINT_URL_DYNAMODB. The SDK
+// reads these env variables too, but the settings also make the S3 client put the bucket in the
+// path. The profile and region env variables are read by the SDK when the config is loaded.
+func FromEnv() (s Settings) {
+	s.EndpointURL = os.Getenv("AWS_ENDPOINT_URL")
+	for _, svc := range Services() {
+		if u := os.Getenv("AWS_ENDPOINT_URL_" + strings.ToUpper(string(svc))); u != "" {
+			if s.Endpoints == nil {
+				s.Endpoints = map[Service]string{}
+			}
+			s.Endpoints[svc] = u
+		}
+	}
+	return
+}
+
+// HasEndpoints returns true if any endpoint is overridden.
+func (s Settings) HasEndpoints() bool {
+	return s.EndpointURL != "" || len(s.Endpoints) > 0
+}
+
+// Validate returns messages describing any problems with the settings.
+func (s Settings) Validate() (messages []string) {
+	if s.EndpointURL != "" {
+		if err := validateURL(s.EndpointURL); err != nil {
+			messages = append(messages, fmt.Sprintf("Invalid endpoint URL %q, %v", s.EndpointURL, err))
+		}
+	}
+	services := make([]string, 0, len(s.Endpoints))
+	for svc := range s.Endpoints {
+		services = append(services, string(svc))
+	}
+	sort.Strings(services)
+	for _, svc := range services {
+		u := s.Endpoints[Service(svc)]
+		if !Service(svc).isValid() {
+			messages = append(messages, fmt.Sprintf("Unknown endpoint service %q, expected one of %v", svc, Services()))
+			continue
+		}
+		if err := validateURL(u); err != nil {
+			messages = append(messages, fmt.Sprintf("Invalid %s endpoint URL %q, %v", svc, u, err))
+		}
+	}
+	return
+}
+
+func validateURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("expected an http or https URL, e.g. http://localhost:4566")
+	}
+	return nil
+}
+
+// Load loads the default AWS config, with the profile, region and retries of the settings. EndpointURL is
+// set as the base endpoint of every service. The endpoints of each service are set by the client
+// options, e.g. DynamoDBOptions.
+func (s Settings) Load(ctx context.Context) (aws.Config, error) {
+	var opts []func(*config.LoadOptions) error
+	if s.Profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(s.Profile))
+	}
+	if s.Region != "" {
+		opts = append(opts, config.WithRegion(s.Region))
+	}
+	if s.RetryMaxAttempts > 0 {
+		opts = append(opts, config.WithRetryMaxAttempts(s.RetryMaxAttempts))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return cfg, err
+	}
+	if s.EndpointURL != "" {
+		cfg.BaseEndpoint = aws.String(s.EndpointURL)
+	}
+	return cfg, nil
+}
+
+// endpoint returns the service's own endpoint, or nil if it isn't overridden.
+func (s Settings) endpoint(svc Service) *string {
+	if u, ok := s.Endpoints[svc]; ok && u != "" {
+		return aws.String(u)
+	}
+	return nil
+}
+
+// CloudWatchOptions sets the CloudWatch endpoint, if it's overridden.
+func (s Settings) CloudWatchOptions(o *cloudwatch.Options) {
+	if u := s.endpoint(ServiceCloudWatch); u != nil {
+		o.BaseEndpoint = u
+	}
+}
+
+// DynamoDBOptions sets the DynamoDB endpoint, if it's overridden.
+func (s Settings) DynamoDBOptions(o *dynamodb.Options) {
+	if u := s.endpoint(ServiceDynamoDB); u != nil {
+		o.BaseEndpoint = u
+	}
+}
+
+// FirehoseOptions sets the Firehose endpoint, if it's overridden.
+func (s Settings) FirehoseOptions(o *firehose.Options) {
+	if u := s.endpoint(ServiceFirehose); u != nil {
+		o.BaseEndpoint = u
+	}
+}
+
+// S3Options sets the S3 endpoint, if it's overridden. Stand-ins such as LocalStack don't support
+// virtual hosted buckets, so overridden endpoints put the bucket in the path.
+func (s Settings) S3Options(o *s3.Options) {
+	if u := s.endpoint(ServiceS3); u != nil {
+		o.BaseEndpoint = u
+	}
+	if s.EndpointURL != "" || o.BaseEndpoint != nil {
+		o.UsePathStyle = true
+	}
+}
@@ -0,0 +1,126 @@
+package awsconfig
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		s        Settings
+		expected []string
+	}{
+		{
+			name: "the zero settings are valid",
+		},
+		{
+			name: "endpoints can be set for every service and each service",
+			s: Settings{
+				EndpointURL: "http://localhost:4566",
+				Endpoints: map[Service]string{
+					ServiceDynamoDB: "http://localhost:8000",
+					ServiceS3:       "https://s3.example.com",
+				},
+			},
+		},
+		{
+			name: "endpoint URLs must be http or https URLs",
+			s: Settings{
+				EndpointURL: "localhost:4566",
+				Endpoints: map[Service]string{
+					ServiceFirehose: "ftp://localhost",
+				},
+			},
+			expected: []string{
+				`Invalid endpoint URL "localhost:4566", expected an http or https URL, e.g. http://localhost:4566`,
+				`Invalid firehose endpoint URL "ftp://localhost", expected an http or https URL, e.g. http://localhost:4566`,
+			},
+		},
+		{
+			name: "endpoints can't be set for unknown services",
+			s: Settings{
+				Endpoints: map[Service]string{
+					"sns": "http://localhost:4566",
+				},
+			},
+			expected: []string{
+				`Unknown endpoint service "sns", expected one of [cloudwatch dynamodb firehose s3]`,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := test.s.Validate()
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("AWS_ENDPOINT_URL", "http://localhost:4566")
+	t.Setenv("AWS_ENDPOINT_URL_DYNAMODB", "http://localhost:8000")
+	expected := Settings{
+		EndpointURL: "http://localhost:4566",
+		Endpoints: map[Service]string{
+			ServiceDynamoDB: "http://localhost:8000",
+		},
+	}
+	if actual := FromEnv(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	s := Settings{
+		EndpointURL: "http://localhost:4566",
+		Endpoints: map[Service]string{
+			ServiceDynamoDB: "http://localhost:8000",
+		},
+	}
+	var d dynamodb.Options
+	s.DynamoDBOptions(&d)
+	if d.BaseEndpoint == nil || *d.BaseEndpoint != "http://localhost:8000" {
+		t.Errorf("expected DynamoDB to use its own endpoint, got %v", aws.ToString(d.BaseEndpoint))
+	}
+	var c cloudwatch.Options
+	s.CloudWatchOptions(&c)
+	if c.BaseEndpoint != nil {
+		t.Errorf("expected CloudWatch to use the base endpoint of the config, got %v", *c.BaseEndpoint)
+	}
+	var o s3.Options
+	s.S3Options(&o)
+	if !o.UsePathStyle {
+		t.Error("expected S3 to put the bucket in the path when an endpoint is overridden")
+	}
+	o = s3.Options{}
+	Settings{}.S3Options(&o)
+	if o.UsePathStyle || o.BaseEndpoint != nil {
+		t.Errorf("expected the default S3 options, got %+v", o)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	t.Setenv("AWS_REGION", "us-east-1")
+	cfg, err := Settings{Region: "eu-west-2", EndpointURL: "http://localhost:4566", RetryMaxAttempts: 1}.Load(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Region != "eu-west-2" {
+		t.Errorf("expected the region to be overridden, got %q", cfg.Region)
+	}
+	if aws.ToString(cfg.BaseEndpoint) != "http://localhost:4566" {
+		t.Errorf("expected the endpoint URL to be the base endpoint, got %q", aws.ToString(cfg.BaseEndpoint))
+	}
+	if cfg.RetryMaxAttempts != 1 {
+		t.Errorf("expected the SDK to make a single attempt, got %d", cfg.RetryMaxAttempts)
+	}
+}
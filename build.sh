@@ -1,3 +1,5 @@
 #!/bin/sh
-GOOS="linux" GOARCH="amd64" go build -o cdk/lambda/processor/lambda -ldflags "-s -w" cdk/lambda/processor/main.go
+for arch in amd64 arm64; do
+	GOOS="linux" GOARCH="$arch" CGO_ENABLED=0 go build -tags lambda.norpc -o cdk/lambda/processor/bin/$arch/bootstrap -ldflags "-s -w" ./cdk/lambda/processor/
+done
 go build
@@ -0,0 +1,334 @@
+package cdk
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsathena"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsglue"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// AthenaSettings configure the Glue database and table, and the Athena workgroup, that make the
+// exported data queryable.
+type AthenaSettings struct {
+	// Database is the name of the Glue database. Defaults to "cwexport".
+	Database string
+	// Table is the name of the Glue table. Defaults to "metric_samples".
+	Table string
+	// Workgroup is the name of the Athena workgroup. Defaults to "cwexport".
+	Workgroup string
+	// ProjectionRange is the range of days that partition projection considers, e.g. "NOW-3YEARS,NOW".
+	// Defaults to the last 3 years.
+	ProjectionRange string
+}
+
+// DefaultAthenaSettings are used for any Athena settings that aren't configured.
+var DefaultAthenaSettings = AthenaSettings{
+	Database:        "cwexport",
+	Table:           "metric_samples",
+	Workgroup:       "cwexport",
+	ProjectionRange: "NOW-3YEARS,NOW",
+}
+
+// Merge returns the settings, with any that are unset taken from the defaults.
+func (s AthenaSettings) Merge(defaults AthenaSettings) AthenaSettings {
+	if s.Database == "" {
+		s.Database = defaults.Database
+	}
+	if s.Table == "" {
+		s.Table = defaults.Table
+	}
+	if s.Workgroup == "" {
+		s.Workgroup = defaults.Workgroup
+	}
+	if s.ProjectionRange == "" {
+		s.ProjectionRange = defaults.ProjectionRange
+	}
+	return s
+}
+
+// ValidateAthena returns messages describing any problems with creating a table for data written
+// using the prefix template.
+func ValidateAthena(prefix string) (messages []string) {
+	if prefix == "" {
+		prefix = PartitionedPrefix
+	}
+	if _, _, _, err := tableLayout("bucket", prefix); err != nil {
+		messages = append(messages, "Invalid prefix for Athena: "+err.Error())
+	}
+	return
+}
+
+// column is a column of the Glue table.
+type column struct {
+	name, typ, comment string
+}
+
+// metricSampleColumns match the JSON of processor.MetricSample. Column names are lower case, and
+// matched to the JSON keys without regard to case.
+var metricSampleColumns = []column{
+	{name: "src", typ: "string", comment: "The exporter that wrote the sample."},
+	{name: "account", typ: "string", comment: "The account the metric was read from, if it isn't the exporter's account."},
+	{name: "region", typ: "string", comment: "The region the metric was read from, if it isn't the exporter's region."},
+	{name: "metric", typ: "struct<namespace:string,metricname:string,dimensions:array<struct<name:string,value:string>>>", comment: "The CloudWatch metric."},
+	{name: "period", typ: "int", comment: "The period of the sample, in seconds."},
+	{name: "stat", typ: "string", comment: "The statistic, e.g. Sum or Average."},
+	{name: "unit", typ: "string", comment: "The unit of the sample, if one was requested."},
+	{name: "sample", typ: "struct<time:string,value:double>", comment: "The time of the sample, in RFC3339 format, and its value."},
+}
+
+// partitionColumns are the names of the table's partition columns for each partition key. The
+// metric key's column is renamed so that it doesn't clash with the metric column.
+var partitionColumns = map[string]string{
+	"namespace":  "namespace",
+	"metric":     "metric_name",
+	"dimensions": "dimensions",
+}
+
+// dayColumn is the name of the partition column for the prefix's timestamp.
+const dayColumn = "day"
+
+// tablePartition is a partition column of the table, taken from an expression in the prefix.
+type tablePartition struct {
+	column string
+	// key is the partition key, or empty for the timestamp.
+	key string
+	// format is the Firehose timestamp format, e.g. yyyy/MM/dd.
+	format string
+}
+
+// tableLayout returns the location of the table and the storage location template used by
+// partition projection, for the prefix template. Each expression in the prefix becomes a partition.
+func tableLayout(bucketName, prefix string) (location, template string, partitions []tablePartition, err error) {
+	// The location is the folder that contains all of the partitions.
+	static := prefix
+	if i := strings.Index(prefix, "!{"); i >= 0 {
+		static = prefix[:i]
+	}
+	location = "s3://" + bucketName + "/" + static[:strings.LastIndex(static, "/")+1]
+	template = "s3://" + bucketName + "/" + prefixExpression.ReplaceAllStringFunc(prefix, func(expr string) string {
+		match := prefixExpression.FindStringSubmatch(expr)
+		if match[1] == "timestamp" {
+			partitions = append(partitions, tablePartition{column: dayColumn, format: match[2]})
+			return "${" + dayColumn + "}"
+		}
+		partitions = append(partitions, tablePartition{column: partitionColumns[match[2]], key: match[2]})
+		return "${" + partitionColumns[match[2]] + "}"
+	})
+	seen := map[string]bool{}
+	for _, p := range partitions {
+		if seen[p.column] {
+			if p.key == "" {
+				return "", "", nil, fmt.Errorf("the prefix can only include one !{timestamp:...} expression when Athena is enabled")
+			}
+			return "", "", nil, fmt.Errorf("the prefix can only include the %q partition key once when Athena is enabled", p.key)
+		}
+		seen[p.column] = true
+	}
+	return
+}
+
+// partitionValues returns the values of the partition keys of the metric's records, matching the
+// values extracted by partitionKeyQuery.
+func partitionValues(m *types.MetricStat) map[string]string {
+	dimensions := make([]string, len(m.Metric.Dimensions))
+	for i, d := range m.Metric.Dimensions {
+		dimensions[i] = *d.Name + "=" + *d.Value
+	}
+	dims := strings.ReplaceAll(strings.Join(dimensions, ";"), "/", "_")
+	if dims == "" {
+		dims = "none"
+	}
+	return map[string]string{
+		"namespace":  strings.ReplaceAll(*m.Metric.Namespace, "/", "_"),
+		"metric":     strings.ReplaceAll(*m.Metric.MetricName, "/", "_"),
+		"dimensions": dims,
+	}
+}
+
+// projectionParameters returns the table parameters that project the partitions. The partition
+// key values are enumerated from the configured metrics.
+func projectionParameters(template string, partitions []tablePartition, metrics []Metric, projectionRange string) map[string]*string {
+	params := map[string]*string{
+		"projection.enabled":        jsii.String("true"),
+		"storage.location.template": jsii.String(template),
+	}
+	for _, p := range partitions {
+		if p.key == "" {
+			params["projection."+p.column+".type"] = jsii.String("date")
+			params["projection."+p.column+".format"] = jsii.String(p.format)
+			params["projection."+p.column+".range"] = jsii.String(projectionRange)
+			params["projection."+p.column+".interval"] = jsii.String("1")
+			params["projection."+p.column+".interval.unit"] = jsii.String("DAYS")
+			continue
+		}
+		values := map[string]bool{}
+		for _, m := range metrics {
+			values[partitionValues(&m.Stat)[p.key]] = true
+		}
+		sorted := make([]string, 0, len(values))
+		for v := range values {
+			sorted = append(sorted, v)
+		}
+		sort.Strings(sorted)
+		params["projection."+p.column+".type"] = jsii.String("enum")
+		params["projection."+p.column+".values"] = jsii.String(strings.Join(sorted, ","))
+	}
+	return params
+}
+
+// athenaDateFormat converts a Firehose timestamp format to an Athena date_format format, or returns
+// false if the format includes unsupported patterns.
+func athenaDateFormat(format string) (string, bool) {
+	converted := strings.NewReplacer("yyyy", "%Y", "MM", "%m", "dd", "%d", "HH", "%H").Replace(format)
+	rest := strings.NewReplacer("%Y", "", "%m", "", "%d", "", "%H", "").Replace(converted)
+	if strings.IndexFunc(rest, unicode.IsLetter) >= 0 {
+		return "", false
+	}
+	return converted, true
+}
+
+// namedQuery is a sample query to save in the workgroup.
+type namedQuery struct {
+	name, description, query string
+}
+
+// sampleQueries returns queries that show how to query the table. If the table is partitioned by
+// day, the queries only read recent partitions.
+func sampleQueries(table string, partitions []tablePartition) []namedQuery {
+	recent := func(days int) string {
+		for _, p := range partitions {
+			if p.key != "" {
+				continue
+			}
+			if format, ok := athenaDateFormat(p.format); ok {
+				return fmt.Sprintf("\nWHERE %s >= date_format(current_date - interval '%d' day, '%s')", dayColumn, days, format)
+			}
+		}
+		return ""
+	}
+	return []namedQuery{
+		{
+			name:        "cwexport-latest-samples",
+			description: "The most recent samples of each metric.",
+			query: fmt.Sprintf(`SELECT metric.namespace, metric.metricname, metric.dimensions, stat, period,
+  from_iso8601_timestamp(sample.time) AS time, sample.value
+FROM %s%s
+ORDER BY time DESC
+LIMIT 100;`, table, recent(1)),
+		},
+		{
+			name:        "cwexport-hourly-values",
+			description: "The hourly average, minimum and maximum of each metric over the last week.",
+			query: fmt.Sprintf(`SELECT metric.namespace, metric.metricname, metric.dimensions, stat,
+  date_trunc('hour', from_iso8601_timestamp(sample.time)) AS hour,
+  avg(sample.value) AS average, min(sample.value) AS minimum, max(sample.value) AS maximum
+FROM %s%s
+GROUP BY 1, 2, 3, 4, 5
+ORDER BY hour DESC;`, table, recent(7)),
+		},
+		{
+			name:        "cwexport-samples-per-day",
+			description: "The number of samples exported for each metric each day, to check for gaps.",
+			query: fmt.Sprintf(`SELECT metric.namespace, metric.metricname, metric.dimensions, stat,
+  date(from_iso8601_timestamp(sample.time)) AS day, count(*) AS samples
+FROM %s%s
+GROUP BY 1, 2, 3, 4, 5
+ORDER BY day DESC;`, table, recent(30)),
+		},
+	}
+}
+
+// newAthenaResources creates the Glue database and table, and the Athena workgroup and sample
+// queries, for the data that's written to the bucket in the format using the prefix template.
+func newAthenaResources(stack awscdk.Stack, bucket awss3.IBucket, prefix string, format Format, metrics []Metric, settings AthenaSettings) (table awsglue.CfnTable) {
+	location, template, partitions, err := tableLayout(*bucket.BucketName(), prefix)
+	if err != nil {
+		panic("Cannot create Athena table: " + err.Error())
+	}
+
+	db := awsglue.NewCfnDatabase(stack, jsii.String("GlueDatabase"), &awsglue.CfnDatabaseProps{
+		CatalogId: stack.Account(),
+		DatabaseInput: &awsglue.CfnDatabase_DatabaseInputProperty{
+			Name:        jsii.String(settings.Database),
+			Description: jsii.String("CloudWatch metrics exported by cwexport."),
+		},
+	})
+
+	columns := make([]interface{}, len(metricSampleColumns))
+	for i, c := range metricSampleColumns {
+		columns[i] = &awsglue.CfnTable_ColumnProperty{
+			Name:    jsii.String(c.name),
+			Type:    jsii.String(c.typ),
+			Comment: jsii.String(c.comment),
+		}
+	}
+	partitionKeys := make([]interface{}, len(partitions))
+	for i, p := range partitions {
+		partitionKeys[i] = &awsglue.CfnTable_ColumnProperty{
+			Name: jsii.String(p.column),
+			Type: jsii.String("string"),
+		}
+	}
+	params := projectionParameters(template, partitions, metrics, settings.ProjectionRange)
+	st := formatStorage[format]
+	params["classification"] = jsii.String(st.classification)
+	table = awsglue.NewCfnTable(stack, jsii.String("GlueTable"), &awsglue.CfnTableProps{
+		CatalogId:    stack.Account(),
+		DatabaseName: jsii.String(settings.Database),
+		TableInput: &awsglue.CfnTable_TableInputProperty{
+			Name:          jsii.String(settings.Table),
+			Description:   jsii.String("Samples exported by cwexport."),
+			TableType:     jsii.String("EXTERNAL_TABLE"),
+			Parameters:    params,
+			PartitionKeys: partitionKeys,
+			StorageDescriptor: &awsglue.CfnTable_StorageDescriptorProperty{
+				Columns:      columns,
+				Location:     jsii.String(location),
+				InputFormat:  jsii.String(st.inputFormat),
+				OutputFormat: jsii.String(st.outputFormat),
+				SerdeInfo: &awsglue.CfnTable_SerdeInfoProperty{
+					SerializationLibrary: jsii.String(st.serde),
+				},
+			},
+		},
+	})
+	table.AddDependsOn(db)
+
+	wg := awsathena.NewCfnWorkGroup(stack, jsii.String("AthenaWorkGroup"), &awsathena.CfnWorkGroupProps{
+		Name:                  jsii.String(settings.Workgroup),
+		Description:           jsii.String("Queries of CloudWatch metrics exported by cwexport."),
+		RecursiveDeleteOption: jsii.Bool(true),
+		WorkGroupConfiguration: &awsathena.CfnWorkGroup_WorkGroupConfigurationProperty{
+			EnforceWorkGroupConfiguration:   jsii.Bool(true),
+			PublishCloudWatchMetricsEnabled: jsii.Bool(true),
+			ResultConfiguration: &awsathena.CfnWorkGroup_ResultConfigurationProperty{
+				OutputLocation: jsii.String(fmt.Sprintf("s3://%s/athena-results/", *bucket.BucketName())),
+			},
+		},
+	})
+
+	for _, q := range sampleQueries(settings.Table, partitions) {
+		nq := awsathena.NewCfnNamedQuery(stack, jsii.String(q.name), &awsathena.CfnNamedQueryProps{
+			Name:        jsii.String(q.name),
+			Description: jsii.String(q.description),
+			Database:    jsii.String(settings.Database),
+			WorkGroup:   wg.Name(),
+			QueryString: jsii.String(q.query),
+		})
+		nq.AddDependsOn(wg)
+		nq.AddDependsOn(db)
+	}
+
+	awscdk.NewCfnOutput(stack, jsii.String("CWAthenaWorkGroupOutput"), &awscdk.CfnOutputProps{
+		ExportName: jsii.String("CWAthenaWorkGroup"),
+		Value:      wg.Name(),
+	})
+	return table
+}
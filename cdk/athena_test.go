@@ -0,0 +1,127 @@
+package cdk
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+func TestTableLayout(t *testing.T) {
+	location, template, partitions, err := tableLayout("bucket", PartitionedPrefix)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if location != "s3://bucket/cwexport/" {
+		t.Errorf("unexpected location %q", location)
+	}
+	expectedTemplate := "s3://bucket/cwexport/namespace=${namespace}/metric=${metric_name}/dimensions=${dimensions}/${day}/"
+	if template != expectedTemplate {
+		t.Errorf("expected template %q, got %q", expectedTemplate, template)
+	}
+	expectedPartitions := []tablePartition{
+		{column: "namespace", key: "namespace"},
+		{column: "metric_name", key: "metric"},
+		{column: "dimensions", key: "dimensions"},
+		{column: "day", format: "yyyy/MM/dd"},
+	}
+	if len(partitions) != len(expectedPartitions) {
+		t.Fatalf("expected partitions %v, got %v", expectedPartitions, partitions)
+	}
+	for i := range expectedPartitions {
+		if partitions[i] != expectedPartitions[i] {
+			t.Errorf("partition %d: expected %v, got %v", i, expectedPartitions[i], partitions[i])
+		}
+	}
+
+	_, _, _, err = tableLayout("bucket", "cwexport/!{timestamp:yyyy}/!{timestamp:MM}/")
+	if err == nil {
+		t.Error("expected an error for more than one timestamp expression")
+	}
+}
+
+func TestPartitionValues(t *testing.T) {
+	tests := []struct {
+		metric   *types.MetricStat
+		expected map[string]string
+	}{
+		{
+			metric:   newMetric("AWS/Lambda", "Invocations", "Sum", 300),
+			expected: map[string]string{"namespace": "AWS_Lambda", "metric": "Invocations", "dimensions": "none"},
+		},
+		{
+			metric: newMetric("pricingApi", "completedPricing", "Sum", 300,
+				types.Dimension{Name: aws.String("ServiceName"), Value: aws.String("pricing/api")},
+				types.Dimension{Name: aws.String("ServiceType"), Value: aws.String("AWS::Lambda::Function")}),
+			expected: map[string]string{"namespace": "pricingApi", "metric": "completedPricing", "dimensions": "ServiceName=pricing_api;ServiceType=AWS::Lambda::Function"},
+		},
+	}
+	for _, test := range tests {
+		actual := partitionValues(test.metric)
+		for k, v := range test.expected {
+			if actual[k] != v {
+				t.Errorf("%s: expected %q, got %q", k, v, actual[k])
+			}
+		}
+	}
+}
+
+func TestProjectionParameters(t *testing.T) {
+	_, template, partitions, _ := tableLayout("bucket", PartitionedPrefix)
+	metrics := []Metric{
+		{Stat: *newMetric("AWS/Lambda", "Invocations", "Sum", 300)},
+		{Stat: *newMetric("AWS/Lambda", "Errors", "Sum", 300)},
+		{Stat: *newMetric("AWS/Lambda", "Errors", "Average", 300)},
+	}
+	params := projectionParameters(template, partitions, metrics, "NOW-3YEARS,NOW")
+	expected := map[string]string{
+		"projection.enabled":            "true",
+		"projection.namespace.type":     "enum",
+		"projection.namespace.values":   "AWS_Lambda",
+		"projection.metric_name.type":   "enum",
+		"projection.metric_name.values": "Errors,Invocations",
+		"projection.dimensions.values":  "none",
+		"projection.day.type":           "date",
+		"projection.day.format":         "yyyy/MM/dd",
+		"projection.day.range":          "NOW-3YEARS,NOW",
+	}
+	for k, v := range expected {
+		if params[k] == nil || *params[k] != v {
+			t.Errorf("%s: expected %q, got %v", k, v, params[k])
+		}
+	}
+}
+
+func TestSampleQueries(t *testing.T) {
+	_, _, partitions, _ := tableLayout("bucket", PartitionedPrefix)
+	for _, q := range sampleQueries("metric_samples", partitions) {
+		if !strings.Contains(q.query, "WHERE day >= date_format(current_date - interval") || !strings.Contains(q.query, "'%Y/%m/%d')") {
+			t.Errorf("%s: expected the query to filter on recent days, got %q", q.name, q.query)
+		}
+	}
+	_, _, partitions, _ = tableLayout("bucket", "cwexport/!{partitionKeyFromQuery:metric}/")
+	for _, q := range sampleQueries("metric_samples", partitions) {
+		if strings.Contains(q.query, "WHERE") {
+			t.Errorf("%s: expected no filter without a day partition, got %q", q.name, q.query)
+		}
+	}
+}
+
+func TestAthenaDateFormat(t *testing.T) {
+	tests := []struct {
+		format   string
+		expected string
+		ok       bool
+	}{
+		{format: "yyyy/MM/dd", expected: "%Y/%m/%d", ok: true},
+		{format: "yyyy-MM-dd-HH", expected: "%Y-%m-%d-%H", ok: true},
+		{format: "yyyy/'week'ww", ok: false},
+	}
+	for _, test := range tests {
+		actual, ok := athenaDateFormat(test.format)
+		if actual != test.expected || ok != test.ok {
+			t.Errorf("%q: expected %q, %v, got %q, %v", test.format, test.expected, test.ok, actual, ok)
+		}
+	}
+}
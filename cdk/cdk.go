@@ -2,40 +2,87 @@ package cdk
 
 import (
 	"embed"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"time"
 
+	"github.com/a-h/cwexport/cw"
 	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awscloudwatch"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsdynamodb"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsevents"
-	"github.com/aws/aws-cdk-go/awscdk/v2/awseventstargets"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskms"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
-	"github.com/aws/aws-cdk-go/awscdk/v2/awslogs"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambdadestinations"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssqs"
 	firehose "github.com/aws/aws-cdk-go/awscdkkinesisfirehosealpha/v2"
 	destinations "github.com/aws/aws-cdk-go/awscdkkinesisfirehosedestinationsalpha/v2"
-	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 	"github.com/aws/constructs-go/constructs/v10"
 	"github.com/aws/jsii-runtime-go"
 )
 
-//go:embed lambda/processor/lambda
+//go:embed lambda/processor/bin/amd64/bootstrap lambda/processor/bin/arm64/bootstrap
 var lambdaBinary embed.FS
 
+// lambdaBinaryPaths are the processor binaries for each architecture, built by build.sh.
+var lambdaBinaryPaths = map[Architecture]string{
+	ArchitectureX86_64: "lambda/processor/bin/amd64/bootstrap",
+	ArchitectureARM64:  "lambda/processor/bin/arm64/bootstrap",
+}
+
 type CDKStackProps struct {
-	// Stats to record.
-	Stats *[]types.MetricStat
+	// Metrics to record.
+	Metrics []Metric
+	// Settings of the processor functions, which can be overridden by each metric's settings. Unset
+	// values are taken from DefaultFunctionSettings.
+	Settings FunctionSettings
 	// FirehoseRoleName allows a custom role to be used for the Firehose. If left empty, a new role will be created.
 	FirehoseRoleName string
 	// BucketName is an optional bucket name to use as a target. If left empty, a new bucket will be created.
 	BucketName string
+	// CheckpointStore is where the processors keep their checkpoints. If left empty, a DynamoDB table is used.
+	CheckpointStore CheckpointStore
+	// Consolidated creates a single processor function and delivery stream that export all of the
+	// metrics, instead of a function and delivery stream for each metric.
+	Consolidated bool
+	// Prefix is the S3 prefix template of the exported data, which can include Firehose
+	// !{timestamp:...} and !{partitionKeyFromQuery:...} expressions, e.g. PartitionedPrefix. If left
+	// empty, each delivery stream writes to its own flat prefix, e.g. cwexport-AWS/Lambda-Invocations,
+	// unless Athena is enabled, when PartitionedPrefix is used.
+	Prefix string
+	// Athena creates a Glue table and Athena workgroup for querying the exported data, if set.
+	Athena *AthenaSettings
+	// Format of the files written to S3. Formats other than JSON require Athena, since the records
+	// are converted using the schema of its Glue table. If left empty, JSON is used.
+	Format Format
+	// Storage configures the bucket lifecycle and encryption.
+	Storage StorageSettings
+	// Alarms configures the alarms on the exporter's resources, and where they notify. Unset values
+	// are taken from DefaultAlarmSettings.
+	Alarms AlarmSettings
 	awscdk.StackProps
 }
 
+// CheckpointStore selects where the processors keep their checkpoints.
+type CheckpointStore string
+
+const (
+	// CheckpointStoreDynamoDB keeps checkpoints, leases and run history in a DynamoDB table.
+	CheckpointStoreDynamoDB CheckpointStore = "dynamodb"
+	// CheckpointStoreS3 keeps checkpoints and leases as JSON objects in the output bucket, under the
+	// checkpoints/ prefix, so that no DynamoDB table is needed.
+	CheckpointStoreS3 CheckpointStore = "s3"
+)
+
+// checkpointPrefix is the prefix of checkpoint objects when using CheckpointStoreS3.
+const checkpointPrefix = "checkpoints"
+
 func NewCDKStack(scope constructs.Construct, id string, props *CDKStackProps) awscdk.Stack {
 	var sprops awscdk.StackProps
 	if props != nil {
@@ -43,115 +90,343 @@ func NewCDKStack(scope constructs.Construct, id string, props *CDKStackProps) aw
 	}
 	stack := awscdk.NewStack(scope, &id, &sprops)
 
-	mob := getOrCreateBucket(stack, props.BucketName)
+	prefix := props.Prefix
+	if prefix == "" && props.Athena != nil {
+		// Athena needs every metric's data under one location, partitioned so that it can be pruned.
+		prefix = PartitionedPrefix
+	}
+	lifecyclePrefix := legacyPrefix
+	if prefix != "" {
+		lifecyclePrefix = dataPrefix(prefix)
+	}
+	key := newKey(stack, props.Storage)
+	mob := getOrCreateBucket(stack, props.BucketName, lifecyclePrefix, props.Storage, key)
 
-	db := awsdynamodb.NewTable(stack, jsii.String("CWExportMetricTable"), &awsdynamodb.TableProps{
-		PartitionKey: &awsdynamodb.Attribute{
-			Name: jsii.String("_pk"),
-			Type: awsdynamodb.AttributeType_STRING,
-		},
-		SortKey: &awsdynamodb.Attribute{
-			Name: jsii.String("_sk"),
-			Type: awsdynamodb.AttributeType_STRING,
-		},
-		BillingMode:         awsdynamodb.BillingMode_PAY_PER_REQUEST,
-		Encryption:          awsdynamodb.TableEncryption_AWS_MANAGED,
-		PointInTimeRecovery: jsii.Bool(true),
-		RemovalPolicy:       awscdk.RemovalPolicy_DESTROY,
-		TimeToLiveAttribute: jsii.String("_ttl"),
-	})
-	awscdk.NewCfnOutput(stack, jsii.String("CWMetricTableOutput"), &awscdk.CfnOutputProps{
-		ExportName: jsii.String("CWTableName"),
-		Value:      db.TableName(),
-	})
+	mon := newMonitoring(stack, props.Alarms)
+	defer mon.createDashboard()
+
+	var db awsdynamodb.Table
+	if props.CheckpointStore != CheckpointStoreS3 {
+		db = awsdynamodb.NewTable(stack, jsii.String("CWExportMetricTable"), &awsdynamodb.TableProps{
+			PartitionKey: &awsdynamodb.Attribute{
+				Name: jsii.String("_pk"),
+				Type: awsdynamodb.AttributeType_STRING,
+			},
+			SortKey: &awsdynamodb.Attribute{
+				Name: jsii.String("_sk"),
+				Type: awsdynamodb.AttributeType_STRING,
+			},
+			BillingMode:         awsdynamodb.BillingMode_PAY_PER_REQUEST,
+			Encryption:          tableEncryption(key),
+			EncryptionKey:       key,
+			PointInTimeRecovery: jsii.Bool(true),
+			RemovalPolicy:       awscdk.RemovalPolicy_DESTROY,
+			TimeToLiveAttribute: jsii.String("_ttl"),
+		})
+		mon.watchTable(db)
+		awscdk.NewCfnOutput(stack, jsii.String("CWMetricTableOutput"), &awscdk.CfnOutputProps{
+			ExportName: jsii.String("CWTableName"),
+			Value:      db.TableName(),
+		})
+	}
+
+	var fhRole awsiam.IRole
+	if props.FirehoseRoleName != "" {
+		fhRole = awsiam.Role_FromRoleName(stack, jsii.String("CustomFirehoseRole"), &props.FirehoseRoleName)
+	}
+
+	format := props.Format
+	if format == "" {
+		format = FormatJSON
+	}
+	var conversion *formatConversion
+	if props.Athena != nil {
+		athena := props.Athena.Merge(DefaultAthenaSettings)
+		table := newAthenaResources(stack, mob, prefix, format, props.Metrics, athena)
+		if format != FormatJSON {
+			if fhRole == nil {
+				fhRole = awsiam.NewRole(stack, jsii.String("FirehoseRole"), &awsiam.RoleProps{
+					AssumedBy: awsiam.NewServicePrincipal(jsii.String("firehose.amazonaws.com"), nil),
+				})
+			}
+			conversion = newFormatConversion(stack, fhRole, table, athena.Database, athena.Table, format)
+		}
+	}
+	dlq := newDeadLetterQueue(stack, key)
+	mon.watchDeadLetterQueue(dlq)
+	res := &exportResources{
+		stack:        stack,
+		dlq:          dlq,
+		prefix:       prefix,
+		bucket:       mob,
+		table:        db,
+		firehoseRole: fhRole,
+		key:          key,
+		conversion:   conversion,
+		codeDirs:     map[Architecture]string{},
+	}
+	defer res.removeCodeDirs()
+	defaults := DefaultFunctionSettings
+	if props.Consolidated {
+		// A single function processes every metric, so give it longer.
+		defaults.Timeout = 5 * time.Minute
+	}
+	settings := props.Settings.Merge(defaults)
+
+	if props.Consolidated {
+		// Write the metric list alongside the Lambda binary, since it can be larger than an
+		// EventBridge rule's input allows.
+		metrics := make([]cw.SourcedMetric, len(props.Metrics))
+		for i := range props.Metrics {
+			metrics[i] = props.Metrics[i].sourced()
+		}
+		metricList, err := json.Marshal(metrics)
+		if err != nil {
+			panic("Cannot marshal metric list: " + err.Error())
+		}
+		dir := res.newCodeDir(settings.Architecture)
+		if err = ioutil.WriteFile(path.Join(dir, metricListFileName), metricList, 0644); err != nil {
+			panic("Cannot write metric list to temporary location: " + err.Error())
+		}
+		fh := res.newDeliveryStream("MetricDeliveryStream", legacyPrefix+"/", legacyPrefix+"_failures/")
+		f := res.newProcessor("Processor", fh, dir, settings, map[string]*string{
+			"METRIC_LIST_FILE": jsii.String(metricListFileName),
+		}, props.Metrics...)
+		mon.addRow(mon.watchProcessor("Processor", f), mon.watchDeliveryStream("MetricDeliveryStream", fh))
+		var lags []awscloudwatch.IWidget
+		for i, id := range metricIDs(props.Metrics) {
+			lags = append(lags, mon.watchLag(id, props.Metrics[i].scoped()))
+		}
+		mon.addRow(lags...)
+		awsevents.NewRule(stack, jsii.String("Scheduler"), &awsevents.RuleProps{
+			Schedule: awsevents.Schedule_Expression(jsii.String(settings.Schedule)),
+			Targets: &[]awsevents.IRuleTarget{
+				res.newTarget(f, nil),
+			},
+		})
+		return stack
+	}
+
+	ids := metricIDs(props.Metrics)
+	for i, m := range props.Metrics {
+		id := ids[i]
+		ms := m.Settings.Merge(settings)
+		fh := res.newDeliveryStream(id+"-MetricDeliveryStream", legacyPrefix+"-"+id, legacyPrefix+"_failures-"+id)
+		f := res.newProcessor(id+"-Processor", fh, res.codeDir(ms.Architecture), ms, nil, m)
+		mon.addRow(mon.watchLag(id, m.scoped()), mon.watchProcessor(id+"-Processor", f), mon.watchDeliveryStream(id+"-MetricDeliveryStream", fh))
+
+		awsevents.NewRule(stack, jsii.String(id+"-Scheduler"), &awsevents.RuleProps{
+			Schedule: awsevents.Schedule_Expression(jsii.String(ms.Schedule)),
+			Targets: &[]awsevents.IRuleTarget{
+				res.newTarget(f, awsevents.RuleTargetInput_FromObject(eventObject(m.sourced()))),
+			},
+		})
+	}
+
+	return stack
+}
+
+// metricListFileName is the file in the Lambda package that lists the metrics for a consolidated
+// processor to export.
+const metricListFileName = "metrics.json"
+
+// exportResources are shared by the delivery streams and processors in the stack.
+type exportResources struct {
+	stack        awscdk.Stack
+	bucket       awss3.IBucket
+	table        awsdynamodb.Table
+	firehoseRole awsiam.IRole
+	// prefix is the prefix template, or empty if each delivery stream writes to its own prefix.
+	prefix string
+	// dlq receives the events that processors fail to process.
+	dlq awssqs.IQueue
+	// key encrypts the delivery streams, if set.
+	key awskms.IKey
+	// conversion converts records to another format, if set.
+	conversion *formatConversion
+	// codeDirs are the directories that contain only the processor binary, by architecture.
+	codeDirs map[Architecture]string
+	// tempDirs are removed once the stack has been created.
+	tempDirs []string
+}
 
+// newCodeDir creates a temporary directory that contains the processor binary, named bootstrap as
+// required by the provided.al2 runtime.
+func (r *exportResources) newCodeDir(arch Architecture) string {
 	dir, err := ioutil.TempDir("", "cwexport")
 	if err != nil {
 		panic("Cannot create temporary directory: " + err.Error())
 	}
-	defer os.RemoveAll(dir)
-	lf, err := lambdaBinary.Open("lambda/processor/lambda")
+	r.tempDirs = append(r.tempDirs, dir)
+	lf, err := lambdaBinary.Open(lambdaBinaryPaths[arch])
 	if err != nil {
 		panic("Cannot open lambda binary: " + err.Error())
 	}
-	tmp, err := os.Create(path.Join(dir, "lambda"))
+	defer lf.Close()
+	tmp, err := os.OpenFile(path.Join(dir, "bootstrap"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
 	if err != nil {
 		panic("Cannot create temporary file in directory: " + err.Error())
 	}
+	defer tmp.Close()
 	_, err = io.Copy(tmp, lf)
 	if err != nil {
 		panic("Cannot copy lambda binary to temporary location: " + err.Error())
 	}
+	return dir
+}
 
-	var fhRole awsiam.IRole
-	if props.FirehoseRoleName != "" {
-		fhRole = awsiam.Role_FromRoleName(stack, jsii.String("CustomFirehoseRole"), &props.FirehoseRoleName)
+// codeDir returns a directory that contains only the processor binary, shared by the functions
+// with the same architecture.
+func (r *exportResources) codeDir(arch Architecture) string {
+	if dir, ok := r.codeDirs[arch]; ok {
+		return dir
 	}
+	dir := r.newCodeDir(arch)
+	r.codeDirs[arch] = dir
+	return dir
+}
 
-	for _, m := range *props.Stats {
-		fh := firehose.NewDeliveryStream(stack, jsii.String(fmt.Sprintf("%s-%s-MetricDeliveryStream", *m.Metric.Namespace, *m.Metric.MetricName)), &firehose.DeliveryStreamProps{
-			Destinations: &[]firehose.IDestination{
-				destinations.NewS3Bucket(mob, &destinations.S3BucketProps{
-					BufferingInterval: awscdk.Duration_Minutes(jsii.Number(1.0)),
-					BufferingSize:     awscdk.Size_Mebibytes(jsii.Number(5.0)),
-					DataOutputPrefix:  jsii.String(fmt.Sprintf("cwexport-%s-%s", *m.Metric.Namespace, *m.Metric.MetricName)),
-					ErrorOutputPrefix: jsii.String(fmt.Sprintf("cwexport_failures-%s-%s", *m.Metric.Namespace, *m.Metric.MetricName)),
-					Role:              fhRole,
-				}),
-			},
-			Encryption: firehose.StreamEncryption_AWS_OWNED,
-		})
+func (r *exportResources) removeCodeDirs() {
+	for _, dir := range r.tempDirs {
+		os.RemoveAll(dir)
+	}
+}
 
-		f := awslambda.NewFunction(stack, jsii.String(fmt.Sprintf("%s-%s-Processor", *m.Metric.Namespace, *m.Metric.MetricName)), &awslambda.FunctionProps{
-			Environment: &map[string]*string{
-				"METRIC_TABLE_NAME":    db.TableName(),
-				"METRIC_FIREHOSE_NAME": fh.DeliveryStreamName(),
-			},
-			LogRetention: awslogs.RetentionDays_FIVE_MONTHS,
-			Code:         awslambda.AssetCode_FromAsset(jsii.String(dir), nil),
-			MemorySize:   jsii.Number(1024),
-			Timeout:      awscdk.Duration_Seconds(jsii.Number(30)),
-			Tracing:      awslambda.Tracing_ACTIVE,
-			Runtime:      awslambda.Runtime_GO_1_X(),
-			Handler:      jsii.String("lambda"),
-			InitialPolicy: &[]awsiam.PolicyStatement{
-				awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
-					Actions:   jsii.Strings("cloudwatch:GetMetricData"),
-					Effect:    awsiam.Effect_ALLOW,
-					Resources: jsii.Strings("*"),
-				}),
-			},
-		})
-		db.GrantReadWriteData(f)
-		fh.GrantPutRecords(f)
+// newDeliveryStream creates a delivery stream that writes to the bucket using the prefix template.
+// If no template is configured, the stream writes to the flat data and error prefixes, as streams
+// did before templates were supported.
+func (r *exportResources) newDeliveryStream(id, flatPrefix, flatErrorPrefix string) firehose.DeliveryStream {
+	prefix, errPrefix := r.prefix, errorPrefix
+	if prefix == "" {
+		prefix, errPrefix = flatPrefix, flatErrorPrefix
+	}
+	// Firehose requires at least 64 MiB of buffer for dynamic partitioning and format conversion.
+	bufferingSize := 5.0
+	dynamic := usesPartitionKeys(prefix)
+	if dynamic || r.conversion != nil {
+		bufferingSize = 64.0
+	}
+	fh := firehose.NewDeliveryStream(r.stack, jsii.String(id), &firehose.DeliveryStreamProps{
+		Destinations: &[]firehose.IDestination{
+			destinations.NewS3Bucket(r.bucket, &destinations.S3BucketProps{
+				BufferingInterval: awscdk.Duration_Minutes(jsii.Number(1.0)),
+				BufferingSize:     awscdk.Size_Mebibytes(jsii.Number(bufferingSize)),
+				DataOutputPrefix:  jsii.String(prefix),
+				ErrorOutputPrefix: jsii.String(errPrefix),
+				Role:              r.firehoseRole,
+				EncryptionKey:     r.key,
+			}),
+		},
+		Encryption:    streamEncryption(r.key),
+		EncryptionKey: r.key,
+	})
+	if dynamic {
+		enableDynamicPartitioning(fh)
+	}
+	if r.conversion != nil {
+		r.conversion.enable(r.stack, fh)
+	}
+	return fh
+}
 
-		awsevents.NewRule(stack, jsii.String(fmt.Sprintf("%s-%s-Scheduler", *m.Metric.Namespace, *m.Metric.MetricName)), &awsevents.RuleProps{
-			Schedule: awsevents.Schedule_Rate(awscdk.Duration_Minutes(jsii.Number(5))),
-			Targets: &[]awsevents.IRuleTarget{
-				awseventstargets.NewLambdaFunction(f, &awseventstargets.LambdaFunctionProps{
-					Event: awsevents.RuleTargetInput_FromObject(m),
-				}),
-			},
-		})
+// newProcessor creates a processor function from the code directory that writes to the delivery
+// stream, and keeps its checkpoints in the table, or in the bucket if there's no table. The function
+// can assume the roles of the metrics it exports.
+func (r *exportResources) newProcessor(id string, fh firehose.DeliveryStream, codeDir string, settings FunctionSettings, extraEnv map[string]*string, metrics ...Metric) awslambda.Function {
+	env := map[string]*string{
+		"METRIC_FIREHOSE_NAME": fh.DeliveryStreamName(),
+		// Hold the lease on each metric for as long as the function can run.
+		"METRIC_LEASE_DURATION": jsii.String(settings.Timeout.String()),
+	}
+	if r.table != nil {
+		env["METRIC_TABLE_NAME"] = r.table.TableName()
+	} else {
+		env["METRIC_STORE"] = jsii.String(fmt.Sprintf("s3://%s/%s", *r.bucket.BucketName(), checkpointPrefix))
+	}
+	for k, v := range extraEnv {
+		env[k] = v
 	}
 
-	return stack
+	f := awslambda.NewFunction(r.stack, jsii.String(id), &awslambda.FunctionProps{
+		Environment:  &env,
+		LogRetention: logRetentionDays[settings.LogRetentionDays],
+		Code:         awslambda.AssetCode_FromAsset(jsii.String(codeDir), nil),
+		MemorySize:   jsii.Number(float64(settings.MemorySize)),
+		Timeout:      awscdk.Duration_Seconds(jsii.Number(settings.Timeout.Seconds())),
+		Tracing:      awslambda.Tracing_ACTIVE,
+		Runtime:      awslambda.Runtime_PROVIDED_AL2(),
+		Architecture: lambdaArchitecture(settings.Architecture),
+		Handler:      jsii.String("bootstrap"),
+		// Send events that fail after retries to the dead-letter queue, with the function's ARN.
+		OnFailure:     awslambdadestinations.NewSqsDestination(r.dlq),
+		RetryAttempts: jsii.Number(functionRetryAttempts),
+		MaxEventAge:   awscdk.Duration_Hours(jsii.Number(maxEventAgeHours)),
+		InitialPolicy: &[]awsiam.PolicyStatement{
+			awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+				Actions:   jsii.Strings("cloudwatch:GetMetricData"),
+				Effect:    awsiam.Effect_ALLOW,
+				Resources: jsii.Strings("*"),
+			}),
+		},
+	})
+	if roles := roleArns(metrics); len(roles) > 0 {
+		f.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+			Actions:   jsii.Strings("sts:AssumeRole"),
+			Effect:    awsiam.Effect_ALLOW,
+			Resources: jsii.Strings(roles...),
+		}))
+	}
+	if r.table != nil {
+		r.table.GrantReadWriteData(f)
+	} else {
+		r.bucket.GrantReadWrite(f, jsii.String(checkpointPrefix+"/*"))
+	}
+	fh.GrantPutRecords(f)
+	return f
 }
 
-func getOrCreateBucket(stack constructs.Construct, bucketName string) awss3.IBucket {
-	if bucketName != "" {
-		return awss3.Bucket_FromBucketName(stack, jsii.String("MetricOutput"), &bucketName)
+// roleArns returns the distinct roles that the metrics are read with.
+func roleArns(metrics []Metric) (roles []string) {
+	seen := map[string]bool{}
+	for _, m := range metrics {
+		if m.Source.RoleArn != "" && !seen[m.Source.RoleArn] {
+			roles = append(roles, m.Source.RoleArn)
+			seen[m.Source.RoleArn] = true
+		}
 	}
-	mob := awss3.NewBucket(stack, jsii.String("MetricOutput"), &awss3.BucketProps{
-		BlockPublicAccess: awss3.BlockPublicAccess_BLOCK_ALL(),
-		EnforceSSL:        jsii.Bool(true),
-		Versioned:         jsii.Bool(true),
-		Encryption:        awss3.BucketEncryption_S3_MANAGED,
-	})
-	mob.AddLifecycleRule(&awss3.LifecycleRule{
-		AbortIncompleteMultipartUploadAfter: awscdk.Duration_Days(jsii.Number(7)), // Save space by clearing up partial uploads.
-		NoncurrentVersionExpiration:         awscdk.Duration_Days(jsii.Number(7)), // Delete old versions after 7 days.
-		Expiration:                          awscdk.Duration_Days(jsii.Number(7)), // Delete files from pipeline bucket after 7 days.
-	})
-	return mob
+	return
+}
+
+// eventObject converts v to the JSON object that the processor function receives, so that embedded
+// fields are flattened in the same way the function unmarshals them.
+func eventObject(v interface{}) (obj map[string]interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic("Cannot marshal event: " + err.Error())
+	}
+	if err = json.Unmarshal(data, &obj); err != nil {
+		panic("Cannot unmarshal event: " + err.Error())
+	}
+	return obj
+}
+
+func lambdaArchitecture(arch Architecture) awslambda.Architecture {
+	if arch == ArchitectureARM64 {
+		return awslambda.Architecture_ARM_64()
+	}
+	return awslambda.Architecture_X86_64()
+}
+
+func tableEncryption(key awskms.IKey) awsdynamodb.TableEncryption {
+	if key != nil {
+		return awsdynamodb.TableEncryption_CUSTOMER_MANAGED
+	}
+	return awsdynamodb.TableEncryption_AWS_MANAGED
+}
+
+func streamEncryption(key awskms.IKey) firehose.StreamEncryption {
+	if key != nil {
+		return firehose.StreamEncryption_CUSTOMER_MANAGED
+	}
+	return firehose.StreamEncryption_AWS_OWNED
 }
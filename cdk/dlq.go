@@ -0,0 +1,60 @@
+package cdk
+
+import (
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsevents"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awseventstargets"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskms"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssqs"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// Failed events are retried, and then sent to the dead-letter queue, where they can be replayed
+// with the replay-dlq command.
+const (
+	// targetRetryAttempts is how many times EventBridge retries an event it can't deliver to a
+	// processor function, e.g. because the function is throttled.
+	targetRetryAttempts = 4
+	// functionRetryAttempts is how many times Lambda retries an event that a processor function
+	// fails to process.
+	functionRetryAttempts = 2
+	// maxEventAgeHours is how long events are retried for. Scheduled runs export anything that is
+	// missed, so older events are only worth replaying from the dead-letter queue.
+	maxEventAgeHours = 1
+	// dlqRetentionDays is how long failed events are kept in the dead-letter queue.
+	dlqRetentionDays = 14
+)
+
+// newDeadLetterQueue creates the queue that receives events that couldn't be delivered to, or
+// processed by, a processor function. If a key is set, the queue is encrypted with it.
+func newDeadLetterQueue(stack awscdk.Stack, key awskms.IKey) awssqs.Queue {
+	props := &awssqs.QueueProps{
+		RetentionPeriod: awscdk.Duration_Days(jsii.Number(dlqRetentionDays)),
+	}
+	if key != nil {
+		props.Encryption = awssqs.QueueEncryption_KMS
+		props.EncryptionMasterKey = key
+		// EventBridge encrypts the events it sends to the queue. This only applies to keys
+		// created by the stack, the policy of an existing key must allow it.
+		key.GrantEncryptDecrypt(awsiam.NewServicePrincipal(jsii.String("events.amazonaws.com"), nil))
+	}
+	q := awssqs.NewQueue(stack, jsii.String("DeadLetterQueue"), props)
+	awscdk.NewCfnOutput(stack, jsii.String("CWDeadLetterQueueOutput"), &awscdk.CfnOutputProps{
+		ExportName: jsii.String("CWDeadLetterQueueUrl"),
+		Value:      q.QueueUrl(),
+	})
+	return q
+}
+
+// newTarget returns a rule target that invokes the processor function with the event, retrying
+// and then sending the event to the dead-letter queue if it can't be delivered.
+func (r *exportResources) newTarget(f awslambda.IFunction, event awsevents.RuleTargetInput) awsevents.IRuleTarget {
+	return awseventstargets.NewLambdaFunction(f, &awseventstargets.LambdaFunctionProps{
+		Event:           event,
+		DeadLetterQueue: r.dlq,
+		RetryAttempts:   jsii.Number(targetRetryAttempts),
+		MaxEventAge:     awscdk.Duration_Hours(jsii.Number(maxEventAgeHours)),
+	})
+}
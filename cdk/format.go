@@ -0,0 +1,145 @@
+package cdk
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsglue"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskinesisfirehose"
+	firehose "github.com/aws/aws-cdk-go/awscdkkinesisfirehosealpha/v2"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// Format is the format of the files written to S3.
+type Format string
+
+const (
+	// FormatJSON writes newline-delimited JSON, as sent by the processors.
+	FormatJSON Format = "json"
+	// FormatParquet converts the records to Apache Parquet, using the schema of the Glue table.
+	FormatParquet Format = "parquet"
+	// FormatORC converts the records to Apache ORC, using the schema of the Glue table.
+	FormatORC Format = "orc"
+)
+
+// storage describes how the Glue table reads a format.
+type storage struct {
+	classification string
+	serde          string
+	inputFormat    string
+	outputFormat   string
+}
+
+var formatStorage = map[Format]storage{
+	FormatJSON: {
+		classification: "json",
+		serde:          "org.openx.data.jsonserde.JsonSerDe",
+		inputFormat:    "org.apache.hadoop.mapred.TextInputFormat",
+		outputFormat:   "org.apache.hadoop.hive.ql.io.HiveIgnoreKeyTextOutputFormat",
+	},
+	FormatParquet: {
+		classification: "parquet",
+		serde:          "org.apache.hadoop.hive.ql.io.parquet.serde.ParquetHiveSerDe",
+		inputFormat:    "org.apache.hadoop.hive.ql.io.parquet.MapredParquetInputFormat",
+		outputFormat:   "org.apache.hadoop.hive.ql.io.parquet.MapredParquetOutputFormat",
+	},
+	FormatORC: {
+		classification: "orc",
+		serde:          "org.apache.hadoop.hive.ql.io.orc.OrcSerde",
+		inputFormat:    "org.apache.hadoop.hive.ql.io.orc.OrcInputFormat",
+		outputFormat:   "org.apache.hadoop.hive.ql.io.orc.OrcOutputFormat",
+	},
+}
+
+// ValidateFormat returns messages describing any problems with the format. Converting records
+// requires the schema of the Glue table, so Athena must be enabled.
+func ValidateFormat(format Format, athena bool) (messages []string) {
+	if format == "" {
+		return
+	}
+	if _, ok := formatStorage[format]; !ok {
+		messages = append(messages, fmt.Sprintf("Unknown format %q, expected %s, %s or %s", format, FormatJSON, FormatParquet, FormatORC))
+		return
+	}
+	if format != FormatJSON && !athena {
+		messages = append(messages, fmt.Sprintf("The %s format uses the schema of the Glue table, so Athena must be enabled", format))
+	}
+	return
+}
+
+// formatConversion is the configuration shared by the delivery streams that convert records.
+type formatConversion struct {
+	format   Format
+	database string
+	table    string
+	// role is the role of the delivery streams, which can read the table.
+	role awsiam.IRole
+	// dependencies must be created before the delivery streams, since they check the schema when
+	// they're created.
+	dependencies []constructs.IDependable
+}
+
+// newFormatConversion gives the role access to the Glue table, so that delivery streams with the
+// role can convert records using its schema.
+func newFormatConversion(stack awscdk.Stack, role awsiam.IRole, table awsglue.CfnTable, database, tableName string, format Format) *formatConversion {
+	policy := awsiam.NewPolicy(stack, jsii.String("FirehoseSchemaPolicy"), &awsiam.PolicyProps{
+		Statements: &[]awsiam.PolicyStatement{
+			awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+				Actions: jsii.Strings("glue:GetTable", "glue:GetTableVersion", "glue:GetTableVersions"),
+				Effect:  awsiam.Effect_ALLOW,
+				Resources: jsii.Strings(
+					fmt.Sprintf("arn:%s:glue:%s:%s:catalog", *stack.Partition(), *stack.Region(), *stack.Account()),
+					fmt.Sprintf("arn:%s:glue:%s:%s:database/%s", *stack.Partition(), *stack.Region(), *stack.Account(), database),
+					fmt.Sprintf("arn:%s:glue:%s:%s:table/%s/%s", *stack.Partition(), *stack.Region(), *stack.Account(), database, tableName),
+				),
+			}),
+		},
+		Roles: &[]awsiam.IRole{role},
+	})
+	return &formatConversion{
+		format:       format,
+		database:     database,
+		table:        tableName,
+		role:         role,
+		dependencies: []constructs.IDependable{policy, table},
+	}
+}
+
+// enable configures the delivery stream to convert the JSON records to the format. The L2
+// construct doesn't support format conversion, so the underlying CloudFormation resource is
+// modified.
+func (c *formatConversion) enable(stack awscdk.Stack, fh firehose.DeliveryStream) {
+	serializer := map[string]interface{}{
+		"ParquetSerDe": map[string]interface{}{},
+	}
+	if c.format == FormatORC {
+		serializer = map[string]interface{}{
+			"OrcSerDe": map[string]interface{}{},
+		}
+	}
+	cfn := fh.Node().DefaultChild().(awskinesisfirehose.CfnDeliveryStream)
+	cfn.AddPropertyOverride(jsii.String("ExtendedS3DestinationConfiguration.DataFormatConversionConfiguration"), map[string]interface{}{
+		"Enabled": true,
+		"InputFormatConfiguration": map[string]interface{}{
+			"Deserializer": map[string]interface{}{
+				"OpenXJsonSerDe": map[string]interface{}{
+					"CaseInsensitive": true,
+				},
+			},
+		},
+		"OutputFormatConfiguration": map[string]interface{}{
+			"Serializer": serializer,
+		},
+		"SchemaConfiguration": map[string]interface{}{
+			"CatalogId":    stack.Account(),
+			"Region":       stack.Region(),
+			"DatabaseName": c.database,
+			"TableName":    c.table,
+			"RoleARN":      c.role.RoleArn(),
+			"VersionId":    "LATEST",
+		},
+	})
+	fh.Node().AddDependency(c.dependencies...)
+}
@@ -0,0 +1,23 @@
+package cdk
+
+import "testing"
+
+func TestValidateFormat(t *testing.T) {
+	tests := []struct {
+		format           Format
+		athena           bool
+		expectedMessages int
+	}{
+		{format: ""},
+		{format: FormatJSON},
+		{format: FormatParquet, athena: true},
+		{format: FormatORC, athena: true},
+		{format: FormatParquet, expectedMessages: 1},
+		{format: "avro", athena: true, expectedMessages: 1},
+	}
+	for _, test := range tests {
+		if messages := ValidateFormat(test.format, test.athena); len(messages) != test.expectedMessages {
+			t.Errorf("%q (athena %v): expected %d messages, got %v", test.format, test.athena, test.expectedMessages, messages)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package cdk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+
+	"github.com/a-h/cwexport/processor"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// metricIDs returns the IDs that identify the metrics in construct IDs. The IDs are in the same
+// order as the metrics, but don't depend on it, so adding or reordering metrics doesn't change the
+// IDs of the others.
+//
+// A metric keeps its namespace and name as its ID, e.g. "AWS/Lambda-Invocations", as it was before
+// metrics could differ only by dimensions, stat, period or source, so that upgrading doesn't replace
+// the resources of existing metrics. That's when it's the only metric with that namespace and name,
+// or when it's the only one of them without dimensions that's read from the stack's own account and
+// region. Other metrics add a short hash of their identity, e.g. "AWS/Lambda-Invocations-3c2746a5".
+func metricIDs(metrics []Metric) []string {
+	named := map[string]int{}
+	defaults := map[string]int{}
+	for i := range metrics {
+		m := &metrics[i]
+		named[legacyMetricID(&m.Stat)]++
+		if isDefault(m) {
+			defaults[legacyMetricID(&m.Stat)]++
+		}
+	}
+	ids := make([]string, len(metrics))
+	for i := range metrics {
+		m := &metrics[i]
+		id := legacyMetricID(&m.Stat)
+		if named[id] == 1 || (isDefault(m) && defaults[id] == 1) {
+			ids[i] = id
+			continue
+		}
+		ids[i] = id + "-" + shortHash(identity(m))
+	}
+	return ids
+}
+
+// isDefault returns true if the metric has no dimensions and is read from the stack's own account
+// and region.
+func isDefault(m *Metric) bool {
+	return len(m.Stat.Metric.Dimensions) == 0 && m.Source.Key() == ""
+}
+
+// identity returns the key of the metric read from its source, with the dimensions sorted by name,
+// so that it doesn't depend on the order the dimensions are listed in.
+func identity(m *Metric) string {
+	scoped := *m.scoped()
+	metric := *scoped.Metric
+	metric.Dimensions = append([]types.Dimension{}, metric.Dimensions...)
+	sort.SliceStable(metric.Dimensions, func(i, j int) bool {
+		return aws.ToString(metric.Dimensions[i].Name) < aws.ToString(metric.Dimensions[j].Name)
+	})
+	scoped.Metric = &metric
+	return processor.MetricKey(&scoped)
+}
+
+// legacyMetricID is the ID of a metric's resources in stacks deployed before metrics could differ
+// only by dimensions, stat or period.
+func legacyMetricID(m *types.MetricStat) string {
+	return *m.Metric.Namespace + "-" + *m.Metric.MetricName
+}
+
+func shortHash(s string) string {
+	hash := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(hash[:4])
+}
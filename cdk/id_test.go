@@ -0,0 +1,104 @@
+package cdk
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/a-h/cwexport/cw"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+func newMetric(namespace, name, stat string, period int32, dimensions ...types.Dimension) *types.MetricStat {
+	return &types.MetricStat{
+		Metric: &types.Metric{
+			Namespace:  aws.String(namespace),
+			MetricName: aws.String(name),
+			Dimensions: dimensions,
+		},
+		Period: aws.Int32(period),
+		Stat:   aws.String(stat),
+	}
+}
+
+func TestMetricIDs(t *testing.T) {
+	invocations := newMetric("AWS/Lambda", "Invocations", "Sum", 300)
+	t.Run("metrics keep the IDs of stacks deployed before dimensions were included", func(t *testing.T) {
+		metrics := []Metric{{Stat: *invocations}, {Stat: *newMetric("AWS/Lambda", "Errors", "Sum", 300)}}
+		ids := metricIDs(metrics)
+		for i, m := range metrics {
+			// The construct IDs that the stack used to create for each metric.
+			legacy := fmt.Sprintf("%s-%s-Processor", *m.Stat.Metric.Namespace, *m.Stat.Metric.MetricName)
+			if actual := ids[i] + "-Processor"; actual != legacy {
+				t.Errorf("expected the legacy construct ID %q, got %q", legacy, actual)
+			}
+		}
+	})
+	fn := func(value string) types.Dimension {
+		return types.Dimension{Name: aws.String("FunctionName"), Value: aws.String(value)}
+	}
+	series := []Metric{
+		{Stat: *invocations},
+		{Stat: *newMetric("AWS/Lambda", "Invocations", "Sum", 300, fn("a"))},
+		{Stat: *newMetric("AWS/Lambda", "Invocations", "Sum", 300, fn("b"))},
+		{Stat: *newMetric("AWS/Lambda", "Invocations", "Average", 300, fn("a"))},
+		{Stat: *newMetric("AWS/Lambda", "Invocations", "Sum", 60, fn("a"))},
+		{Stat: *invocations, Source: cw.Source{Region: "us-east-1"}},
+		{Stat: *newMetric("AWS/Lambda", "Errors", "Sum", 300, fn("a"))},
+	}
+	t.Run("metrics that differ only by dimensions, stat, period or source get different IDs", func(t *testing.T) {
+		ids := metricIDs(series)
+		if ids[0] != "AWS/Lambda-Invocations" {
+			t.Errorf("expected the metric without dimensions to keep its legacy ID, got %q", ids[0])
+		}
+		if ids[6] != "AWS/Lambda-Errors" {
+			t.Errorf("expected the only metric with its name to keep its legacy ID, got %q", ids[6])
+		}
+		if ids[1] != "AWS/Lambda-Invocations-57e8c1aa" {
+			t.Errorf("expected a stable ID, got %q", ids[1])
+		}
+		seen := map[string]bool{}
+		for _, id := range ids {
+			if seen[id] {
+				t.Errorf("duplicate ID %q", id)
+			}
+			seen[id] = true
+		}
+	})
+	t.Run("metrics keep their IDs when metrics are reordered", func(t *testing.T) {
+		expected := metricIDs(series)
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 20; i++ {
+			order := r.Perm(len(series))
+			shuffled := make([]Metric, len(series))
+			for j, k := range order {
+				shuffled[j] = series[k]
+			}
+			ids := metricIDs(shuffled)
+			for j, k := range order {
+				if ids[j] != expected[k] {
+					t.Errorf("order %v: expected metric %d to keep the ID %q, got %q", order, k, expected[k], ids[j])
+				}
+			}
+		}
+	})
+	t.Run("metrics keep their IDs when metrics are added", func(t *testing.T) {
+		expected := metricIDs(series)
+		added := append([]Metric{{Stat: *newMetric("AWS/Lambda", "Invocations", "Maximum", 300, fn("c"))}}, series...)
+		ids := metricIDs(added)[1:]
+		for i := range expected {
+			if ids[i] != expected[i] {
+				t.Errorf("expected metric %d to keep the ID %q, got %q", i, expected[i], ids[i])
+			}
+		}
+	})
+	t.Run("the order of dimensions doesn't change the ID", func(t *testing.T) {
+		env := types.Dimension{Name: aws.String("Env"), Value: aws.String("prod")}
+		a := metricIDs(append([]Metric{{Stat: *newMetric("AWS/Lambda", "Invocations", "Sum", 300, fn("a"), env)}}, series...))
+		b := metricIDs(append([]Metric{{Stat: *newMetric("AWS/Lambda", "Invocations", "Sum", 300, env, fn("a"))}}, series...))
+		if a[0] != b[0] {
+			t.Errorf("expected the same ID, got %q and %q", a[0], b[0])
+		}
+	})
+}
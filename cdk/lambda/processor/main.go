@@ -2,22 +2,35 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/a-h/cwexport/awsconfig"
 	"github.com/a-h/cwexport/cw"
 	"github.com/a-h/cwexport/db"
 	"github.com/a-h/cwexport/firehose"
 	"github.com/a-h/cwexport/processor"
+	"github.com/a-h/cwexport/s3store"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 	"go.uber.org/zap"
 )
 
 var log *zap.Logger
-var proc processor.Processor
+var procs *processors
+
+const (
+	// concurrency is how many metrics are processed at the same time, when the event has more than one.
+	concurrency = 25
+	// batchWait is how long to wait for other metrics to request the same window from CloudWatch.
+	batchWait = 25 * time.Millisecond
+)
 
 func main() {
 	var err error
@@ -27,7 +40,11 @@ func main() {
 	}
 	defer log.Sync()
 
-	cfg, err := config.LoadDefaultConfig(context.Background())
+	// Endpoints can be overridden by env variables, e.g. to run the function in LocalStack.
+	awsSettings := awsconfig.FromEnv()
+	// The processor retries transient errors with backoff, so the clients make a single attempt.
+	awsSettings.RetryMaxAttempts = 1
+	cfg, err := awsSettings.Load(context.Background())
 	if err != nil {
 		panic(fmt.Errorf("failed to load aws config %w", err))
 	}
@@ -37,7 +54,7 @@ func main() {
 		log.Fatal("Missing METRIC_FIREHOSE_NAME env variable")
 		return
 	}
-	fh, err := firehose.New(cfg, firehoseName)
+	fh, err := firehose.New(cfg, firehoseName, awsSettings.FirehoseOptions)
 	if err != nil {
 		log.Fatal("Cannot create firehose", zap.Error(err))
 		return
@@ -51,35 +68,235 @@ func main() {
 		}
 	}
 
-	tableName := os.Getenv("METRIC_TABLE_NAME")
-	if tableName == "" {
-		log.Fatal("Missing METRIC_TABLE_NAME env variable")
-		return
-	}
-	store, err := db.NewMetricStore(tableName, cfg.Region)
+	store, err := openStore(cfg, awsSettings)
 	if err != nil {
 		log.Fatal("Cannot create store", zap.Error(err))
 		return
 	}
 
-	proc, err = processor.New(log, store, fh.Put, cw.Cloudwatch{})
-	if err != nil {
-		log.Error("Failed to create new processor", zap.Error(err))
-		return
+	leaseDuration := time.Minute
+	if leaseDurationEnv := os.Getenv("METRIC_LEASE_DURATION"); leaseDurationEnv != "" {
+		leaseDuration, err = time.ParseDuration(leaseDurationEnv)
+		if err != nil {
+			log.Fatal("Unable to parse METRIC_LEASE_DURATION", zap.Error(err))
+			return
+		}
+	}
+
+	// Take a lease on the metric, so that a slow run doesn't overlap with the next scheduled run.
+	// Write the processor's metrics to the logs in Embedded Metric Format, so that CloudWatch
+	// extracts them without any API calls.
+	opts := []processor.OptionsFunc{
+		processor.WithLease(store, leaseDuration),
+		processor.WithMetricsWriter(os.Stdout),
+	}
+	if rr, ok := store.(processor.RunRecorder); ok {
+		opts = append(opts, processor.WithRunRecorder(rr))
+	}
+	procs = &processors{
+		cfg:         cfg,
+		awsSettings: awsSettings,
+		store:       store,
+		putter:      fh.Put,
+		opts:        opts,
+		single:      map[cw.Source]processor.Processor{},
+		batch:       map[cw.Source]processor.Processor{},
 	}
 
 	lambda.Start(Handle)
 }
 
-var metricStartTime = time.Now().Add(time.Minute * -1)
+// processors are created for each source when it's first used, since each source needs its own
+// CloudWatch client.
+type processors struct {
+	cfg         aws.Config
+	awsSettings awsconfig.Settings
+	store       store
+	putter      processor.MetricPutter
+	opts        []processor.OptionsFunc
+	single      map[cw.Source]processor.Processor
+	batch       map[cw.Source]processor.Processor
+}
+
+// get returns the processor for a single metric from the source.
+func (ps *processors) get(s cw.Source) (p processor.Processor, err error) {
+	if p, ok := ps.single[s]; ok {
+		return p, nil
+	}
+	opts := append([]processor.OptionsFunc{processor.WithSource(s)}, ps.opts...)
+	p, err = processor.New(log, ps.store, ps.putter, cw.NewFromSource(ps.cfg, s, ps.awsSettings.CloudWatchOptions), opts...)
+	if err == nil {
+		ps.single[s] = p
+	}
+	return
+}
+
+// getBatch returns the processor for many metrics from the source, which combines their requests to
+// CloudWatch.
+func (ps *processors) getBatch(s cw.Source) (p processor.Processor, err error) {
+	if p, ok := ps.batch[s]; ok {
+		return p, nil
+	}
+	opts := append([]processor.OptionsFunc{processor.WithSource(s), processor.WithConcurrency(concurrency)}, ps.opts...)
+	p, err = processor.New(log, ps.store, ps.putter, cw.NewBatcherFromSource(ps.cfg, s, batchWait, ps.awsSettings.CloudWatchOptions), opts...)
+	if err == nil {
+		ps.batch[s] = p
+	}
+	return
+}
+
+// group is a set of metrics that are read from the same source, and start from the same time.
+type group struct {
+	source cw.Source
+	start  time.Time
+}
+
+// processAll processes the metrics of each source concurrently. The results are in the same order
+// as the metrics.
+func (ps *processors) processAll(ctx context.Context, metrics []cw.SourcedMetric) (results []processor.Result, err error) {
+	var groups []group
+	indexes := map[group][]int{}
+	for i, m := range metrics {
+		g := group{source: m.Source, start: startTime(m)}
+		if _, ok := indexes[g]; !ok {
+			groups = append(groups, g)
+		}
+		indexes[g] = append(indexes[g], i)
+	}
+	// Create the processors before starting any, so that a failure doesn't leave others running.
+	procs := make([]processor.Processor, len(groups))
+	for i, g := range groups {
+		if procs[i], err = ps.getBatch(g.source); err != nil {
+			return nil, err
+		}
+	}
+	results = make([]processor.Result, len(metrics))
+	errs := make([]error, len(groups))
+	var wg sync.WaitGroup
+	for i, g := range groups {
+		wg.Add(1)
+		go func(i int, p processor.Processor, start time.Time, idx []int) {
+			defer wg.Done()
+			stats := make([]types.MetricStat, len(idx))
+			for j, k := range idx {
+				stats[j] = metrics[k].MetricStat
+			}
+			res, err := p.ProcessAll(ctx, start, stats)
+			for j, k := range idx {
+				results[k] = res[j]
+			}
+			errs[i] = err
+		}(i, procs[i], g.start, indexes[g])
+	}
+	wg.Wait()
+	var failures []string
+	for _, err := range errs {
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		err = errors.New(strings.Join(failures, "; "))
+	}
+	return
+}
+
+type store interface {
+	processor.MetricStore
+	processor.Leaser
+}
+
+// openStore uses the S3 store if METRIC_STORE is set to an s3://bucket/prefix URL, otherwise the
+// DynamoDB table in METRIC_TABLE_NAME.
+func openStore(cfg aws.Config, awsSettings awsconfig.Settings) (store, error) {
+	if url := os.Getenv("METRIC_STORE"); url != "" {
+		return s3store.Open(cfg, url, awsSettings.S3Options)
+	}
+	tableName := os.Getenv("METRIC_TABLE_NAME")
+	if tableName == "" {
+		return nil, errors.New("missing METRIC_STORE or METRIC_TABLE_NAME env variable")
+	}
+	return db.NewMetricStoreFromConfig(cfg, tableName, awsSettings.DynamoDBOptions)
+}
+
+// Start exporting from the start of the previous minute, so that metrics processed together request
+// the same windows, and can be batched.
+var metricStartTime = time.Now().Add(time.Minute * -1).Truncate(processor.Interval)
+
+// startTime returns the time to start exporting the metric from, if it has no checkpoint.
+func startTime(m cw.SourcedMetric) time.Time {
+	if m.StartTime != nil {
+		return *m.StartTime
+	}
+	return metricStartTime
+}
 
-func Handle(ctx context.Context, event types.MetricStat) (err error) {
+// Event is the scheduled event. It contains a single metric to process, or a list of Metrics to
+// process concurrently. If it has neither, the list of metrics is read from the file in the
+// METRIC_LIST_FILE env variable.
+type Event struct {
+	cw.SourcedMetric
+	Metrics []cw.SourcedMetric `json:"Metrics,omitempty"`
+}
+
+func readMetricList() (metrics []cw.SourcedMetric, err error) {
+	fileName := os.Getenv("METRIC_LIST_FILE")
+	if fileName == "" {
+		return nil, errors.New("the event has no metrics, and there's no METRIC_LIST_FILE env variable")
+	}
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metric list: %w", err)
+	}
+	if err = json.Unmarshal(data, &metrics); err != nil {
+		return nil, fmt.Errorf("failed to parse metric list: %w", err)
+	}
+	return metrics, nil
+}
+
+func Handle(ctx context.Context, event Event) (results []processor.Result, err error) {
 	log.Info("Received event", zap.Any("event", event))
 
-	err = proc.Process(ctx, metricStartTime, &event)
+	if event.Metric != nil {
+		var proc processor.Processor
+		if proc, err = procs.get(event.Source); err != nil {
+			log.Error("Failed to create new processor", zap.Error(err))
+			return
+		}
+		var res processor.Result
+		res, err = proc.Process(ctx, startTime(event.SourcedMetric), &event.MetricStat)
+		logSummary(log, res)
+		if err != nil {
+			log.Error("An error occured during processing", zap.Error(err))
+		}
+		return []processor.Result{res}, err
+	}
+
+	metrics := event.Metrics
+	if len(metrics) == 0 {
+		if metrics, err = readMetricList(); err != nil {
+			log.Error("Failed to get the list of metrics", zap.Error(err))
+			return
+		}
+	}
+	results, err = procs.processAll(ctx, metrics)
+	for i, res := range results {
+		logSummary(log.With(zap.String("metric", processor.SourceMetricKey(metrics[i].Source, &metrics[i].MetricStat))), res)
+	}
 	if err != nil {
 		log.Error("An error occured during processing", zap.Error(err))
-		return
 	}
-	return nil
+	return
+}
+
+func logSummary(log *zap.Logger, res processor.Result) {
+	log.Info("Processing summary",
+		zap.Int("windowCount", res.WindowCount),
+		zap.Int("sampleCount", res.SampleCount),
+		zap.Time("position", res.Position),
+		zap.Duration("lag", res.Lag),
+		zap.Bool("deadlineReached", res.DeadlineReached),
+		zap.Bool("skipped", res.Skipped),
+		zap.Bool("conflict", res.Conflict),
+		zap.Int("errorCount", len(res.Errors)))
 }
@@ -0,0 +1,260 @@
+package cdk
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/a-h/cwexport/processor"
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awscloudwatch"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awscloudwatchactions"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsdynamodb"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssns"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssnssubscriptions"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssqs"
+	firehose "github.com/aws/aws-cdk-go/awscdkkinesisfirehosealpha/v2"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// AlarmSettings configure the alarms on the exporter's own resources.
+type AlarmSettings struct {
+	// Topic creates an SNS topic that the alarms notify.
+	Topic bool
+	// Email subscribes the address to the alarm topic, creating the topic if needed.
+	Email string
+	// LagThreshold is how far a metric's checkpoint can fall behind before its lag alarm fires.
+	LagThreshold time.Duration
+}
+
+// DefaultAlarmSettings are used for any settings that aren't configured.
+var DefaultAlarmSettings = AlarmSettings{
+	LagThreshold: time.Hour,
+}
+
+// Merge returns the settings, with any unset values taken from the defaults.
+func (s AlarmSettings) Merge(defaults AlarmSettings) AlarmSettings {
+	if s.LagThreshold == 0 {
+		s.LagThreshold = defaults.LagThreshold
+	}
+	return s
+}
+
+// Validate returns messages describing any problems with the settings.
+func (s AlarmSettings) Validate() (messages []string) {
+	if s.Email != "" && !strings.Contains(s.Email, "@") {
+		messages = append(messages, fmt.Sprintf("Invalid alarm Email %q", s.Email))
+	}
+	if s.LagThreshold < 0 {
+		messages = append(messages, fmt.Sprintf("Invalid LagThreshold %s, must be positive", s.LagThreshold))
+	}
+	if s.LagThreshold > maxLagThreshold {
+		messages = append(messages, fmt.Sprintf("Invalid LagThreshold %s, must be at most %s", s.LagThreshold, maxLagThreshold))
+	}
+	return
+}
+
+// alarmPeriod is the period of the alarms and dashboard graphs.
+var alarmPeriod = awscdk.Duration_Minutes(jsii.Number(5))
+
+// maxLagThreshold is the longest period that a CloudWatch alarm can evaluate.
+const maxLagThreshold = 24 * time.Hour
+
+// lagAlarmPeriod returns the period of the lag alarm, which is the threshold rounded up to whole
+// minutes, and at least the period of the other alarms.
+func lagAlarmPeriod(threshold time.Duration) time.Duration {
+	period := (threshold + time.Minute - 1) / time.Minute * time.Minute
+	if period < 5*time.Minute {
+		period = 5 * time.Minute
+	}
+	return period
+}
+
+// dashboardWidth is the width of a CloudWatch dashboard, in grid units.
+const dashboardWidth = 24
+
+// monitoring collects the alarms and dashboard widgets for the stack's resources.
+type monitoring struct {
+	stack    awscdk.Stack
+	settings AlarmSettings
+	// action notifies the topic, if there is one.
+	action awscloudwatch.IAlarmAction
+	alarms []awscloudwatch.IAlarm
+	rows   [][]awscloudwatch.IWidget
+}
+
+func newMonitoring(stack awscdk.Stack, settings AlarmSettings) *monitoring {
+	m := &monitoring{
+		stack:    stack,
+		settings: settings.Merge(DefaultAlarmSettings),
+	}
+	if m.settings.Topic || m.settings.Email != "" {
+		topic := awssns.NewTopic(stack, jsii.String("AlarmTopic"), &awssns.TopicProps{
+			DisplayName: jsii.String("cwexport alarms"),
+		})
+		if m.settings.Email != "" {
+			topic.AddSubscription(awssnssubscriptions.NewEmailSubscription(jsii.String(m.settings.Email), nil))
+		}
+		m.action = awscloudwatchactions.NewSnsAction(topic)
+		awscdk.NewCfnOutput(stack, jsii.String("CWAlarmTopicOutput"), &awscdk.CfnOutputProps{
+			ExportName: jsii.String("CWAlarmTopic"),
+			Value:      topic.TopicArn(),
+		})
+	}
+	return m
+}
+
+// addAlarm creates an alarm that fires when the metric is at or above the threshold for one period,
+// or below it if below is set.
+func (m *monitoring) addAlarm(id, description string, metric awscloudwatch.IMetric, threshold float64, below bool, missing awscloudwatch.TreatMissingData) {
+	op := awscloudwatch.ComparisonOperator_GREATER_THAN_OR_EQUAL_TO_THRESHOLD
+	if below {
+		op = awscloudwatch.ComparisonOperator_LESS_THAN_THRESHOLD
+	}
+	alarm := awscloudwatch.NewAlarm(m.stack, jsii.String(id), &awscloudwatch.AlarmProps{
+		AlarmDescription:   jsii.String(description),
+		Metric:             metric,
+		Threshold:          jsii.Number(threshold),
+		EvaluationPeriods:  jsii.Number(1),
+		ComparisonOperator: op,
+		TreatMissingData:   missing,
+	})
+	if m.action != nil {
+		alarm.AddAlarmAction(m.action)
+		alarm.AddOkAction(m.action)
+	}
+	m.alarms = append(m.alarms, alarm)
+}
+
+// addRow adds a row of widgets to the dashboard, which wraps if they don't fit its width.
+func (m *monitoring) addRow(widgets ...awscloudwatch.IWidget) {
+	m.rows = append(m.rows, widgets)
+}
+
+// watchProcessor alarms on the function's errors and throttles, and returns a graph of them.
+func (m *monitoring) watchProcessor(id string, f awslambda.Function) awscloudwatch.IWidget {
+	opts := &awscloudwatch.MetricOptions{Period: alarmPeriod, Statistic: jsii.String("Sum")}
+	errors, throttles := f.MetricErrors(opts), f.MetricThrottles(opts)
+	m.addAlarm(id+"-ErrorsAlarm", "The cwexport processor "+id+" failed.", errors, 1, false, awscloudwatch.TreatMissingData_NOT_BREACHING)
+	m.addAlarm(id+"-ThrottlesAlarm", "The cwexport processor "+id+" was throttled.", throttles, 1, false, awscloudwatch.TreatMissingData_NOT_BREACHING)
+	return newGraph("Processor", f.MetricInvocations(opts), errors, throttles)
+}
+
+// watchDeliveryStream alarms when the delivery stream fails to write to S3, and returns a graph of
+// the records it receives and its delivery success.
+func (m *monitoring) watchDeliveryStream(id string, fh firehose.DeliveryStream) awscloudwatch.IWidget {
+	success := fh.Metric(jsii.String("DeliveryToS3.Success"), &awscloudwatch.MetricOptions{Period: alarmPeriod, Statistic: jsii.String("Minimum")})
+	m.addAlarm(id+"-DeliveryAlarm", "The cwexport delivery stream "+id+" failed to deliver records to S3.", success, 1, true, awscloudwatch.TreatMissingData_NOT_BREACHING)
+	records := fh.MetricIncomingRecords(&awscloudwatch.MetricOptions{Period: alarmPeriod, Statistic: jsii.String("Sum")})
+	return awscloudwatch.NewGraphWidget(&awscloudwatch.GraphWidgetProps{
+		Title: jsii.String("Delivery"),
+		Left:  &[]awscloudwatch.IMetric{records},
+		Right: &[]awscloudwatch.IMetric{success},
+		Width: jsii.Number(dashboardWidth / 3),
+	})
+}
+
+// watchTable alarms on throttled reads and writes of the checkpoint table.
+func (m *monitoring) watchTable(table awsdynamodb.Table) {
+	opts := &awscloudwatch.MetricOptions{Period: alarmPeriod, Statistic: jsii.String("Sum")}
+	throttles := awscloudwatch.NewMathExpression(&awscloudwatch.MathExpressionProps{
+		Expression: jsii.String("reads + writes"),
+		UsingMetrics: &map[string]awscloudwatch.IMetric{
+			"reads":  table.Metric(jsii.String("ReadThrottleEvents"), opts),
+			"writes": table.Metric(jsii.String("WriteThrottleEvents"), opts),
+		},
+		Label:  jsii.String("Throttled requests"),
+		Period: alarmPeriod,
+	})
+	m.addAlarm("CWExportMetricTable-ThrottlesAlarm", "Requests to the cwexport checkpoint table were throttled.", throttles, 1, false, awscloudwatch.TreatMissingData_NOT_BREACHING)
+	m.addRow(newGraph("Checkpoint table throttles", throttles))
+}
+
+// exporterMetric returns one of the metrics that the processor writes for the metric key.
+func exporterMetric(name, key, statistic string) awscloudwatch.Metric {
+	return awscloudwatch.NewMetric(&awscloudwatch.MetricProps{
+		Namespace:     jsii.String(processor.MetricsNamespace),
+		MetricName:    jsii.String(name),
+		DimensionsMap: &map[string]*string{processor.MetricKeyDimension: jsii.String(key)},
+		Statistic:     jsii.String(statistic),
+		Period:        alarmPeriod,
+	})
+}
+
+// watchDeadLetterQueue alarms when events are sent to the dead-letter queue.
+func (m *monitoring) watchDeadLetterQueue(q awssqs.IQueue) {
+	visible := q.MetricApproximateNumberOfMessagesVisible(&awscloudwatch.MetricOptions{Period: alarmPeriod, Statistic: jsii.String("Maximum")})
+	m.addAlarm("DeadLetterQueueAlarm", "Events failed and were sent to the cwexport dead-letter queue, see the replay-dlq command.", visible, 1, false, awscloudwatch.TreatMissingData_NOT_BREACHING)
+	m.addRow(newGraph("Dead-letter queue", visible))
+}
+
+// watchLag alarms when the metric's checkpoint falls too far behind, and returns a graph of its lag,
+// the samples exported and the API errors.
+func (m *monitoring) watchLag(id string, stat *types.MetricStat) awscloudwatch.IWidget {
+	key := processor.MetricKey(stat)
+	lag := exporterMetric(processor.CheckpointLagMetric, key, "Maximum")
+	// Missing data is breaching, so that the alarm fires if the processor stops running. If no run
+	// reports the lag for as long as the threshold, the checkpoint is at least that far behind, so
+	// the alarm's period is the threshold.
+	period := lagAlarmPeriod(m.settings.LagThreshold)
+	alarmLag := lag.With(&awscloudwatch.MetricOptions{Period: awscdk.Duration_Minutes(jsii.Number(period.Minutes()))})
+	m.addAlarm(id+"-LagAlarm", fmt.Sprintf("The cwexport checkpoint of %s is more than %s behind, or hasn't been reported for %s.", key, m.settings.LagThreshold, period), alarmLag, m.settings.LagThreshold.Seconds(), false, awscloudwatch.TreatMissingData_BREACHING)
+	return awscloudwatch.NewGraphWidget(&awscloudwatch.GraphWidgetProps{
+		Title: jsii.String(key),
+		Left:  &[]awscloudwatch.IMetric{lag},
+		Right: &[]awscloudwatch.IMetric{
+			exporterMetric(processor.SamplesExportedMetric, key, "Sum"),
+			exporterMetric(processor.APIErrorsMetric, key, "Sum"),
+		},
+		LeftAnnotations: &[]*awscloudwatch.HorizontalAnnotation{{Value: jsii.Number(m.settings.LagThreshold.Seconds()), Label: jsii.String("Lag alarm")}},
+		Width:           jsii.Number(dashboardWidth / 3),
+	})
+}
+
+// maxAlarmsPerWidget is the most alarms that an alarm status widget can show.
+const maxAlarmsPerWidget = 100
+
+// createDashboard creates a dashboard that shows the state of the alarms, followed by the rows. The
+// dashboard is named after the stack, so that several stacks can be deployed to the same account.
+func (m *monitoring) createDashboard() {
+	d := awscloudwatch.NewDashboard(m.stack, jsii.String("Dashboard"), &awscloudwatch.DashboardProps{
+		DashboardName: m.stack.StackName(),
+	})
+	groups := groupAlarms(m.alarms, maxAlarmsPerWidget)
+	for i := range groups {
+		title := "Alarms"
+		if len(groups) > 1 {
+			title = fmt.Sprintf("Alarms (%d of %d)", i+1, len(groups))
+		}
+		d.AddWidgets(awscloudwatch.NewAlarmStatusWidget(&awscloudwatch.AlarmStatusWidgetProps{
+			Title:  jsii.String(title),
+			Alarms: &groups[i],
+			Width:  jsii.Number(dashboardWidth),
+		}))
+	}
+	for _, row := range m.rows {
+		d.AddWidgets(row...)
+	}
+}
+
+// groupAlarms splits the alarms into groups of at most size alarms.
+func groupAlarms(alarms []awscloudwatch.IAlarm, size int) (groups [][]awscloudwatch.IAlarm) {
+	for len(alarms) > size {
+		groups = append(groups, alarms[:size])
+		alarms = alarms[size:]
+	}
+	if len(alarms) > 0 {
+		groups = append(groups, alarms)
+	}
+	return
+}
+
+func newGraph(title string, metrics ...awscloudwatch.IMetric) awscloudwatch.IWidget {
+	return awscloudwatch.NewGraphWidget(&awscloudwatch.GraphWidgetProps{
+		Title: jsii.String(title),
+		Left:  &metrics,
+		Width: jsii.Number(dashboardWidth / 3),
+	})
+}
@@ -0,0 +1,94 @@
+package cdk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/a-h/cwexport/processor"
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/assertions"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awscloudwatch"
+	"github.com/aws/jsii-runtime-go"
+)
+
+func TestAlarmSettingsValidate(t *testing.T) {
+	tests := []struct {
+		name             string
+		settings         AlarmSettings
+		expectedMessages int
+	}{
+		{name: "defaults", settings: DefaultAlarmSettings},
+		{name: "email", settings: AlarmSettings{Email: "ops@example.com", LagThreshold: 30 * time.Minute}},
+		{name: "invalid email", settings: AlarmSettings{Email: "ops"}, expectedMessages: 1},
+		{name: "negative lag threshold", settings: AlarmSettings{LagThreshold: -time.Minute}, expectedMessages: 1},
+		{name: "lag threshold too long", settings: AlarmSettings{LagThreshold: 25 * time.Hour}, expectedMessages: 1},
+	}
+	for _, test := range tests {
+		if messages := test.settings.Validate(); len(messages) != test.expectedMessages {
+			t.Errorf("%s: expected %d messages, got %v", test.name, test.expectedMessages, messages)
+		}
+	}
+}
+
+func TestAlarmSettingsMerge(t *testing.T) {
+	if actual := (AlarmSettings{}).Merge(DefaultAlarmSettings); actual.LagThreshold != DefaultAlarmSettings.LagThreshold {
+		t.Errorf("expected default lag threshold %s, got %s", DefaultAlarmSettings.LagThreshold, actual.LagThreshold)
+	}
+	if actual := (AlarmSettings{LagThreshold: time.Minute}).Merge(DefaultAlarmSettings); actual.LagThreshold != time.Minute {
+		t.Errorf("expected lag threshold %s, got %s", time.Minute, actual.LagThreshold)
+	}
+}
+
+func TestGroupAlarms(t *testing.T) {
+	tests := []struct {
+		alarms   int
+		expected []int
+	}{
+		{alarms: 0},
+		{alarms: 1, expected: []int{1}},
+		{alarms: 100, expected: []int{100}},
+		{alarms: 101, expected: []int{100, 1}},
+		{alarms: 250, expected: []int{100, 100, 50}},
+	}
+	for _, test := range tests {
+		groups := groupAlarms(make([]awscloudwatch.IAlarm, test.alarms), maxAlarmsPerWidget)
+		if len(groups) != len(test.expected) {
+			t.Errorf("%d alarms: expected %d groups, got %d", test.alarms, len(test.expected), len(groups))
+			continue
+		}
+		for i, g := range groups {
+			if len(g) != test.expected[i] {
+				t.Errorf("%d alarms: expected group %d to have %d alarms, got %d", test.alarms, i, test.expected[i], len(g))
+			}
+		}
+	}
+}
+
+func TestLagAlarmPeriod(t *testing.T) {
+	tests := []struct {
+		threshold time.Duration
+		expected  time.Duration
+	}{
+		{threshold: time.Minute, expected: 5 * time.Minute},
+		{threshold: time.Hour, expected: time.Hour},
+		{threshold: 90 * time.Second, expected: 5 * time.Minute},
+		{threshold: 10*time.Minute + time.Second, expected: 11 * time.Minute},
+	}
+	for _, test := range tests {
+		if actual := lagAlarmPeriod(test.threshold); actual != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.threshold, test.expected, actual)
+		}
+	}
+}
+
+func TestLagAlarmFiresWhenTheExporterStops(t *testing.T) {
+	stack := awscdk.NewStack(awscdk.NewApp(nil), jsii.String("Test"), nil)
+	m := newMonitoring(stack, AlarmSettings{})
+	m.watchLag("AWS/Lambda-Invocations", newMetric("AWS/Lambda", "Invocations", "Sum", 300))
+	assertions.Template_FromStack(stack).HasResourceProperties(jsii.String("AWS::CloudWatch::Alarm"), map[string]interface{}{
+		"MetricName":       processor.CheckpointLagMetric,
+		"Period":           3600,
+		"Threshold":        3600,
+		"TreatMissingData": "breaching",
+	})
+}
@@ -0,0 +1,107 @@
+package cdk
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskinesisfirehose"
+	firehose "github.com/aws/aws-cdk-go/awscdkkinesisfirehosealpha/v2"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// PartitionedPrefix is a prefix template that partitions the data by metric and day, in a layout
+// that Athena can prune. It's used if Athena is enabled and no prefix is configured.
+const PartitionedPrefix = "cwexport/namespace=!{partitionKeyFromQuery:namespace}/metric=!{partitionKeyFromQuery:metric}/dimensions=!{partitionKeyFromQuery:dimensions}/!{timestamp:yyyy/MM/dd}/"
+
+// errorPrefix is where Firehose writes records that it fails to deliver or partition, if a prefix
+// template is configured.
+const errorPrefix = "cwexport_failures/!{firehose:error-output-type}/!{timestamp:yyyy/MM/dd}/"
+
+// legacyPrefix starts the prefixes that are used if no prefix template is configured. The
+// consolidated delivery stream writes to "cwexport/", and each metric's delivery stream to
+// "cwexport-<metric ID>", with failures in "cwexport_failures/" and "cwexport_failures-<metric ID>",
+// as they did before templates were supported. The bucket's lifecycle rules apply to all of them.
+const legacyPrefix = "cwexport"
+
+// partitionKeyQuery extracts the partition keys from a processor.MetricSample record. Slashes,
+// e.g. in the AWS/Lambda namespace, are replaced, so that each key is a single level of the prefix.
+// Dimensions are joined with ";", since Athena enum projections are comma separated. Metrics without
+// dimensions are partitioned under "none".
+const partitionKeyQuery = `{` +
+	`namespace: .Metric.Namespace | gsub("/"; "_"), ` +
+	`metric: .Metric.MetricName | gsub("/"; "_"), ` +
+	`dimensions: ([.Metric.Dimensions[]? | "\(.Name)=\(.Value)"] | join(";") | gsub("/"; "_") | if . == "" then "none" else . end)` +
+	`}`
+
+// PartitionKeys are the keys that can be used in a prefix template as !{partitionKeyFromQuery:<key>}.
+var PartitionKeys = []string{"namespace", "metric", "dimensions"}
+
+var prefixExpression = regexp.MustCompile(`!\{([^}:]+):?([^}]*)\}`)
+
+// usesPartitionKeys returns true if the prefix template requires dynamic partitioning.
+func usesPartitionKeys(prefix string) bool {
+	return strings.Contains(prefix, "!{partitionKeyFromQuery:")
+}
+
+// ValidatePrefix returns messages describing any problems with the prefix template.
+func ValidatePrefix(prefix string) (messages []string) {
+	if prefix == "" {
+		return
+	}
+	// The bucket's lifecycle rules apply to the fixed part of the prefix, so it mustn't include the
+	// checkpoints kept in the bucket.
+	if fixed := dataPrefix(prefix); fixed == "" || strings.HasPrefix(checkpointPrefix, fixed) || strings.HasPrefix(fixed, checkpointPrefix+"/") {
+		messages = append(messages, fmt.Sprintf("Invalid prefix %q, expected it to start with a fixed path other than %s/, e.g. cwexport/, since lifecycle rules apply to everything under it", prefix, checkpointPrefix))
+	}
+	for _, match := range prefixExpression.FindAllStringSubmatch(prefix, -1) {
+		namespace, key := match[1], match[2]
+		switch namespace {
+		case "timestamp":
+			if key == "" {
+				messages = append(messages, fmt.Sprintf("Invalid prefix expression %q, expected a timestamp format, e.g. !{timestamp:yyyy/MM/dd}", match[0]))
+			}
+		case "partitionKeyFromQuery":
+			if !contains(PartitionKeys, key) {
+				messages = append(messages, fmt.Sprintf("Unknown partition key %q in prefix, expected one of %s", key, strings.Join(PartitionKeys, ", ")))
+			}
+		default:
+			messages = append(messages, fmt.Sprintf("Unsupported prefix expression %q, expected !{timestamp:...} or !{partitionKeyFromQuery:...}", match[0]))
+		}
+	}
+	return
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// enableDynamicPartitioning configures the delivery stream to extract the partition keys from each
+// record. The L2 construct doesn't support dynamic partitioning, so the underlying
+// CloudFormation resource is modified.
+func enableDynamicPartitioning(fh firehose.DeliveryStream) {
+	cfn := fh.Node().DefaultChild().(awskinesisfirehose.CfnDeliveryStream)
+	cfn.AddPropertyOverride(jsii.String("ExtendedS3DestinationConfiguration.DynamicPartitioningConfiguration"), map[string]interface{}{
+		"Enabled": true,
+		"RetryOptions": map[string]interface{}{
+			"DurationInSeconds": 300,
+		},
+	})
+	cfn.AddPropertyOverride(jsii.String("ExtendedS3DestinationConfiguration.ProcessingConfiguration"), map[string]interface{}{
+		"Enabled": true,
+		"Processors": []interface{}{
+			map[string]interface{}{
+				"Type": "MetadataExtraction",
+				"Parameters": []interface{}{
+					map[string]interface{}{"ParameterName": "MetadataExtractionQuery", "ParameterValue": partitionKeyQuery},
+					map[string]interface{}{"ParameterName": "JsonParsingEngine", "ParameterValue": "JQ-1.6"},
+				},
+			},
+		},
+	})
+}
@@ -0,0 +1,37 @@
+package cdk
+
+import "testing"
+
+func TestValidatePrefix(t *testing.T) {
+	tests := []struct {
+		prefix           string
+		expectedMessages int
+	}{
+		{prefix: ""},
+		{prefix: PartitionedPrefix},
+		{prefix: "cwexport/!{timestamp:yyyy/MM/dd}/"},
+		{prefix: "data/"},
+		{prefix: "cwexport/!{partitionKeyFromQuery:region}/", expectedMessages: 1},
+		{prefix: "cwexport/!{timestamp}/", expectedMessages: 1},
+		{prefix: "cwexport/!{firehose:random-string}/", expectedMessages: 1},
+		{prefix: "!{timestamp:yyyy/MM/dd}/", expectedMessages: 1},
+		{prefix: "!{partitionKeyFromQuery:namespace}/", expectedMessages: 1},
+		{prefix: "c", expectedMessages: 1},
+		{prefix: "checkpoints/data/", expectedMessages: 1},
+		{prefix: "checkpoints-data/"},
+	}
+	for _, test := range tests {
+		if messages := ValidatePrefix(test.prefix); len(messages) != test.expectedMessages {
+			t.Errorf("%q: expected %d messages, got %v", test.prefix, test.expectedMessages, messages)
+		}
+	}
+}
+
+func TestUsesPartitionKeys(t *testing.T) {
+	if !usesPartitionKeys(PartitionedPrefix) {
+		t.Error("expected the default prefix to use dynamic partitioning")
+	}
+	if usesPartitionKeys("cwexport/!{timestamp:yyyy/MM/dd}/") {
+		t.Error("expected a timestamp-only prefix not to use dynamic partitioning")
+	}
+}
@@ -0,0 +1,139 @@
+package cdk
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/a-h/cwexport/cw"
+	"github.com/a-h/cwexport/processor"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// Metric is a metric to export, where to read it from, and the settings of the function that
+// exports it.
+type Metric struct {
+	Stat   types.MetricStat
+	Source cw.Source
+	// StartTime is the time to start exporting from, if the metric has no checkpoint. If it's zero,
+	// the processor starts from the time it first runs.
+	StartTime time.Time
+	Settings  FunctionSettings
+}
+
+// scoped returns the metric as it's identified in stores, IDs and the processor's metrics.
+func (m *Metric) scoped() *types.MetricStat {
+	return processor.ScopedMetric(m.Source, &m.Stat)
+}
+
+// sourced returns the metric as the processor function receives it.
+func (m *Metric) sourced() cw.SourcedMetric {
+	sm := cw.SourcedMetric{MetricStat: m.Stat, Source: m.Source}
+	if !m.StartTime.IsZero() {
+		start := m.StartTime
+		sm.StartTime = &start
+	}
+	return sm
+}
+
+// Architecture is the instruction set of a processor function.
+type Architecture string
+
+const (
+	ArchitectureX86_64 Architecture = "x86_64"
+	ArchitectureARM64  Architecture = "arm64"
+)
+
+// FunctionSettings configure a processor function and its schedule. Zero values are left unset, so
+// that they can be filled in by Merge.
+type FunctionSettings struct {
+	// Schedule is an EventBridge schedule expression, e.g. "rate(5 minutes)" or "cron(0/5 * * * ? *)".
+	Schedule         string
+	MemorySize       int
+	Timeout          time.Duration
+	Architecture     Architecture
+	LogRetentionDays int
+}
+
+// DefaultFunctionSettings are used for any settings that aren't configured.
+var DefaultFunctionSettings = FunctionSettings{
+	Schedule:         "rate(5 minutes)",
+	MemorySize:       1024,
+	Timeout:          30 * time.Second,
+	Architecture:     ArchitectureX86_64,
+	LogRetentionDays: 150,
+}
+
+// Merge returns the settings, with any that are unset taken from the defaults.
+func (s FunctionSettings) Merge(defaults FunctionSettings) FunctionSettings {
+	if s.Schedule == "" {
+		s.Schedule = defaults.Schedule
+	}
+	if s.MemorySize == 0 {
+		s.MemorySize = defaults.MemorySize
+	}
+	if s.Timeout == 0 {
+		s.Timeout = defaults.Timeout
+	}
+	if s.Architecture == "" {
+		s.Architecture = defaults.Architecture
+	}
+	if s.LogRetentionDays == 0 {
+		s.LogRetentionDays = defaults.LogRetentionDays
+	}
+	return s
+}
+
+// IsZero returns true if none of the settings are set.
+func (s FunctionSettings) IsZero() bool {
+	return s == FunctionSettings{}
+}
+
+var scheduleExpression = regexp.MustCompile(`^(rate|cron)\(.+\)$`)
+
+var logRetentionDays = map[int]awslogs.RetentionDays{
+	1:    awslogs.RetentionDays_ONE_DAY,
+	3:    awslogs.RetentionDays_THREE_DAYS,
+	5:    awslogs.RetentionDays_FIVE_DAYS,
+	7:    awslogs.RetentionDays_ONE_WEEK,
+	14:   awslogs.RetentionDays_TWO_WEEKS,
+	30:   awslogs.RetentionDays_ONE_MONTH,
+	60:   awslogs.RetentionDays_TWO_MONTHS,
+	90:   awslogs.RetentionDays_THREE_MONTHS,
+	120:  awslogs.RetentionDays_FOUR_MONTHS,
+	150:  awslogs.RetentionDays_FIVE_MONTHS,
+	180:  awslogs.RetentionDays_SIX_MONTHS,
+	365:  awslogs.RetentionDays_ONE_YEAR,
+	400:  awslogs.RetentionDays_THIRTEEN_MONTHS,
+	545:  awslogs.RetentionDays_EIGHTEEN_MONTHS,
+	731:  awslogs.RetentionDays_TWO_YEARS,
+	1827: awslogs.RetentionDays_FIVE_YEARS,
+	3653: awslogs.RetentionDays_TEN_YEARS,
+}
+
+// Validate returns messages describing any settings that are set, but invalid.
+func (s FunctionSettings) Validate() (messages []string) {
+	if s.Schedule != "" && !scheduleExpression.MatchString(s.Schedule) {
+		messages = append(messages, fmt.Sprintf("Invalid schedule %q, expected a rate(...) or cron(...) expression", s.Schedule))
+	}
+	if s.MemorySize != 0 && (s.MemorySize < 128 || s.MemorySize > 10240) {
+		messages = append(messages, fmt.Sprintf("Invalid memory size %d, expected 128 to 10240 MB", s.MemorySize))
+	}
+	if s.Timeout != 0 && (s.Timeout < time.Second || s.Timeout > 15*time.Minute || s.Timeout%time.Second != 0) {
+		messages = append(messages, fmt.Sprintf("Invalid timeout %v, expected a whole number of seconds from 1s to 15m", s.Timeout))
+	}
+	if s.Architecture != "" && s.Architecture != ArchitectureX86_64 && s.Architecture != ArchitectureARM64 {
+		messages = append(messages, fmt.Sprintf("Invalid architecture %q, expected %s or %s", s.Architecture, ArchitectureX86_64, ArchitectureARM64))
+	}
+	if _, ok := logRetentionDays[s.LogRetentionDays]; s.LogRetentionDays != 0 && !ok {
+		days := make([]int, 0, len(logRetentionDays))
+		for d := range logRetentionDays {
+			days = append(days, d)
+		}
+		sort.Ints(days)
+		messages = append(messages, fmt.Sprintf("Invalid log retention %d days, expected one of %v", s.LogRetentionDays, days))
+	}
+	return
+}
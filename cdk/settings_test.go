@@ -0,0 +1,102 @@
+package cdk
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFunctionSettingsMerge(t *testing.T) {
+	global := FunctionSettings{
+		Schedule:     "rate(1 minute)",
+		Architecture: ArchitectureARM64,
+	}.Merge(DefaultFunctionSettings)
+	metric := FunctionSettings{
+		Schedule:   "cron(0/10 * * * ? *)",
+		MemorySize: 256,
+	}.Merge(global)
+
+	expected := FunctionSettings{
+		Schedule:         "cron(0/10 * * * ? *)",
+		MemorySize:       256,
+		Timeout:          30 * time.Second,
+		Architecture:     ArchitectureARM64,
+		LogRetentionDays: 150,
+	}
+	if metric != expected {
+		t.Errorf("expected %+v, got %+v", expected, metric)
+	}
+}
+
+func TestFunctionSettingsValidate(t *testing.T) {
+	tests := []struct {
+		name             string
+		settings         FunctionSettings
+		expectedMessages int
+	}{
+		{
+			name:     "unset settings are valid",
+			settings: FunctionSettings{},
+		},
+		{
+			name:     "the defaults are valid",
+			settings: DefaultFunctionSettings,
+		},
+		{
+			name: "cron expressions are valid",
+			settings: FunctionSettings{
+				Schedule: "cron(0/5 * * * ? *)",
+			},
+		},
+		{
+			name: "schedules must be rate or cron expressions",
+			settings: FunctionSettings{
+				Schedule: "every 5 minutes",
+			},
+			expectedMessages: 1,
+		},
+		{
+			name: "memory, timeout, architecture and log retention must be in range",
+			settings: FunctionSettings{
+				MemorySize:       64,
+				Timeout:          20 * time.Minute,
+				Architecture:     "mips",
+				LogRetentionDays: 10,
+			},
+			expectedMessages: 4,
+		},
+		{
+			name: "timeouts must be whole seconds",
+			settings: FunctionSettings{
+				Timeout: 1500 * time.Millisecond,
+			},
+			expectedMessages: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			messages := test.settings.Validate()
+			if len(messages) != test.expectedMessages {
+				t.Errorf("expected %d messages, got %v", test.expectedMessages, messages)
+			}
+		})
+	}
+}
+
+func TestMetricEventStartTime(t *testing.T) {
+	start := time.Date(2021, time.March, 21, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		metric   Metric
+		expected interface{}
+	}{
+		{name: "metrics without a start time use the processor's default", metric: Metric{Stat: *newMetric("AWS/Lambda", "Invocations", "Sum", 300)}},
+		{name: "metrics with a start time include it", metric: Metric{Stat: *newMetric("AWS/Lambda", "Invocations", "Sum", 300), StartTime: start}, expected: "2021-03-21T09:00:00Z"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := eventObject(test.metric.sourced())["StartTime"]; actual != test.expected {
+				t.Errorf("expected start time %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package cdk
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskms"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// StorageSettings configure the lifecycle of the exported data, and the encryption of the bucket,
+// delivery streams and DynamoDB table. By default, exported data is kept forever.
+type StorageSettings struct {
+	// ExpireAfterDays deletes exported data after the number of days. Zero keeps it forever.
+	ExpireAfterDays int
+	// InfrequentAccessAfterDays moves exported data to the Standard-IA storage class after the
+	// number of days, which must be at least 30. Zero leaves it in the Standard storage class.
+	InfrequentAccessAfterDays int
+	// GlacierAfterDays moves exported data to the Glacier storage class after the number of days.
+	// Zero leaves it where it is.
+	GlacierAfterDays int
+	// Versioned keeps previous versions of overwritten and deleted objects. Defaults to true.
+	Versioned *bool
+	// NoncurrentVersionExpireAfterDays deletes previous versions after the number of days. Defaults to 7.
+	NoncurrentVersionExpireAfterDays int
+	// KMSKeyArn is a customer managed KMS key used to encrypt the bucket, delivery streams and table.
+	KMSKeyArn string
+	// CreateKMSKey creates a customer managed KMS key, with rotation enabled, instead of using KMSKeyArn.
+	CreateKMSKey bool
+}
+
+// hasLifecycle returns true if any of the settings that only apply to a new bucket are set.
+func (s StorageSettings) hasLifecycle() bool {
+	return s.ExpireAfterDays != 0 || s.InfrequentAccessAfterDays != 0 || s.GlacierAfterDays != 0 ||
+		s.Versioned != nil || s.NoncurrentVersionExpireAfterDays != 0
+}
+
+// ValidateStorage returns messages describing any problems with the settings. Lifecycle settings
+// can't be applied to an existing bucket.
+func ValidateStorage(s StorageSettings, existingBucket bool) (messages []string) {
+	if existingBucket && s.hasLifecycle() {
+		messages = append(messages, "Lifecycle and versioning settings can't be applied to an existing bucket, configure them on the bucket instead")
+	}
+	if s.ExpireAfterDays < 0 || s.InfrequentAccessAfterDays < 0 || s.GlacierAfterDays < 0 || s.NoncurrentVersionExpireAfterDays < 0 {
+		messages = append(messages, "Storage days can't be negative")
+	}
+	if s.InfrequentAccessAfterDays != 0 && s.InfrequentAccessAfterDays < 30 {
+		messages = append(messages, fmt.Sprintf("Invalid InfrequentAccessAfterDays %d, S3 requires at least 30 days", s.InfrequentAccessAfterDays))
+	}
+	if s.InfrequentAccessAfterDays != 0 && s.GlacierAfterDays != 0 && s.GlacierAfterDays <= s.InfrequentAccessAfterDays {
+		messages = append(messages, "GlacierAfterDays must be after InfrequentAccessAfterDays")
+	}
+	if s.ExpireAfterDays != 0 {
+		for _, transition := range []int{s.InfrequentAccessAfterDays, s.GlacierAfterDays} {
+			if transition != 0 && s.ExpireAfterDays <= transition {
+				messages = append(messages, "ExpireAfterDays must be after the storage class transitions")
+				break
+			}
+		}
+	}
+	if s.KMSKeyArn != "" && s.CreateKMSKey {
+		messages = append(messages, "Set either KMSKeyArn or CreateKMSKey, not both")
+	}
+	if s.KMSKeyArn != "" && !strings.HasPrefix(s.KMSKeyArn, "arn:") {
+		messages = append(messages, fmt.Sprintf("Invalid KMSKeyArn %q, expected a key ARN", s.KMSKeyArn))
+	}
+	return
+}
+
+// newKey returns the customer managed key to encrypt with, or nil if the AWS managed keys are used.
+func newKey(scope constructs.Construct, s StorageSettings) awskms.IKey {
+	if s.KMSKeyArn != "" {
+		return awskms.Key_FromKeyArn(scope, jsii.String("EncryptionKey"), jsii.String(s.KMSKeyArn))
+	}
+	if s.CreateKMSKey {
+		return awskms.NewKey(scope, jsii.String("EncryptionKey"), &awskms.KeyProps{
+			Description:       jsii.String("Encrypts CloudWatch metrics exported by cwexport."),
+			EnableKeyRotation: jsii.Bool(true),
+			RemovalPolicy:     awscdk.RemovalPolicy_RETAIN,
+		})
+	}
+	return nil
+}
+
+// getOrCreateBucket imports the named bucket, or creates a bucket. The lifecycle rules of a new
+// bucket apply to the objects under the data prefix.
+func getOrCreateBucket(stack constructs.Construct, bucketName string, dataPrefix string, s StorageSettings, key awskms.IKey) awss3.IBucket {
+	if bucketName != "" {
+		return awss3.Bucket_FromBucketName(stack, jsii.String("MetricOutput"), &bucketName)
+	}
+	versioned := true
+	if s.Versioned != nil {
+		versioned = *s.Versioned
+	}
+	props := &awss3.BucketProps{
+		BlockPublicAccess: awss3.BlockPublicAccess_BLOCK_ALL(),
+		EnforceSSL:        jsii.Bool(true),
+		Versioned:         jsii.Bool(versioned),
+		Encryption:        awss3.BucketEncryption_S3_MANAGED,
+	}
+	if key != nil {
+		props.Encryption = awss3.BucketEncryption_KMS
+		props.EncryptionKey = key
+		props.BucketKeyEnabled = jsii.Bool(true)
+	}
+	mob := awss3.NewBucket(stack, jsii.String("MetricOutput"), props)
+
+	// Save space by clearing up partial uploads.
+	bucketRule := &awss3.LifecycleRule{
+		AbortIncompleteMultipartUploadAfter: awscdk.Duration_Days(jsii.Number(7)),
+	}
+	if versioned {
+		noncurrentDays := s.NoncurrentVersionExpireAfterDays
+		if noncurrentDays == 0 {
+			noncurrentDays = 7
+		}
+		bucketRule.NoncurrentVersionExpiration = awscdk.Duration_Days(jsii.Number(float64(noncurrentDays)))
+	}
+	mob.AddLifecycleRule(bucketRule)
+
+	// Only apply expiry and transitions to the exported data, so that checkpoints kept in the
+	// bucket stay readable.
+	dataRule := &awss3.LifecycleRule{
+		Prefix: jsii.String(dataPrefix),
+	}
+	var transitions []*awss3.Transition
+	if s.InfrequentAccessAfterDays != 0 {
+		transitions = append(transitions, &awss3.Transition{
+			StorageClass:    awss3.StorageClass_INFREQUENT_ACCESS(),
+			TransitionAfter: awscdk.Duration_Days(jsii.Number(float64(s.InfrequentAccessAfterDays))),
+		})
+	}
+	if s.GlacierAfterDays != 0 {
+		transitions = append(transitions, &awss3.Transition{
+			StorageClass:    awss3.StorageClass_GLACIER(),
+			TransitionAfter: awscdk.Duration_Days(jsii.Number(float64(s.GlacierAfterDays))),
+		})
+	}
+	if len(transitions) > 0 {
+		dataRule.Transitions = &transitions
+	}
+	if s.ExpireAfterDays != 0 {
+		dataRule.Expiration = awscdk.Duration_Days(jsii.Number(float64(s.ExpireAfterDays)))
+	}
+	if len(transitions) > 0 || s.ExpireAfterDays != 0 {
+		mob.AddLifecycleRule(dataRule)
+	}
+	return mob
+}
+
+// dataPrefix returns the fixed part of the prefix template, before any expressions.
+func dataPrefix(prefix string) string {
+	if i := strings.Index(prefix, "!{"); i >= 0 {
+		return prefix[:i]
+	}
+	return prefix
+}
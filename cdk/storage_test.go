@@ -0,0 +1,50 @@
+package cdk
+
+import "testing"
+
+func TestValidateStorage(t *testing.T) {
+	unversioned := false
+	tests := []struct {
+		name             string
+		settings         StorageSettings
+		existingBucket   bool
+		expectedMessages int
+	}{
+		{name: "defaults"},
+		{name: "defaults with an existing bucket", existingBucket: true},
+		{name: "previous behaviour", settings: StorageSettings{ExpireAfterDays: 7}},
+		{name: "transitions", settings: StorageSettings{InfrequentAccessAfterDays: 30, GlacierAfterDays: 90, ExpireAfterDays: 365}},
+		{name: "glacier only", settings: StorageSettings{GlacierAfterDays: 1}},
+		{name: "unversioned", settings: StorageSettings{Versioned: &unversioned}},
+		{name: "kms key", settings: StorageSettings{KMSKeyArn: "arn:aws:kms:eu-west-1:123456789012:key/abc"}, existingBucket: true},
+		{name: "created kms key", settings: StorageSettings{CreateKMSKey: true}},
+		{name: "lifecycle on an existing bucket", settings: StorageSettings{ExpireAfterDays: 7}, existingBucket: true, expectedMessages: 1},
+		{name: "negative", settings: StorageSettings{ExpireAfterDays: -1}, expectedMessages: 1},
+		{name: "infrequent access too soon", settings: StorageSettings{InfrequentAccessAfterDays: 7}, expectedMessages: 1},
+		{name: "glacier before infrequent access", settings: StorageSettings{InfrequentAccessAfterDays: 60, GlacierAfterDays: 30}, expectedMessages: 1},
+		{name: "expiry before transition", settings: StorageSettings{GlacierAfterDays: 30, ExpireAfterDays: 7}, expectedMessages: 1},
+		{name: "both kms settings", settings: StorageSettings{KMSKeyArn: "arn:aws:kms:eu-west-1:123456789012:key/abc", CreateKMSKey: true}, expectedMessages: 1},
+		{name: "kms key id", settings: StorageSettings{KMSKeyArn: "abc"}, expectedMessages: 1},
+	}
+	for _, test := range tests {
+		if messages := ValidateStorage(test.settings, test.existingBucket); len(messages) != test.expectedMessages {
+			t.Errorf("%s: expected %d messages, got %v", test.name, test.expectedMessages, messages)
+		}
+	}
+}
+
+func TestDataPrefix(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		expected string
+	}{
+		{prefix: PartitionedPrefix, expected: "cwexport/namespace="},
+		{prefix: "exports/", expected: "exports/"},
+		{prefix: "!{timestamp:yyyy}/", expected: ""},
+	}
+	for _, test := range tests {
+		if actual := dataPrefix(test.prefix); actual != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.prefix, test.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package checkpointcmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/a-h/cwexport/awsconfig"
+	"github.com/a-h/cwexport/db"
+	"github.com/a-h/cwexport/processor"
+)
+
+type Action string
+
+const (
+	ActionList   Action = "list"
+	ActionGet    Action = "get"
+	ActionSet    Action = "set"
+	ActionRewind Action = "rewind"
+	ActionDelete Action = "delete"
+)
+
+func IsValidAction(a Action) bool {
+	switch a {
+	case ActionList, ActionGet, ActionSet, ActionRewind, ActionDelete:
+		return true
+	}
+	return false
+}
+
+type Args struct {
+	Action Action
+	// Key of the metric, see processor.MetricKey. Not required for the list action.
+	Key string
+	// To is the time to set the checkpoint to.
+	To time.Time
+	// By is the duration to rewind the checkpoint by.
+	By time.Duration
+	// DryRun prints the change that would be made, without making it.
+	DryRun bool
+	// TableName is the DynamoDB table that holds the checkpoints, used if Store is nil.
+	TableName string
+	// Store holds the checkpoints, instead of the DynamoDB table.
+	Store processor.CheckpointEditor
+	// AWS configures the profile, region and endpoints of the AWS clients.
+	AWS    awsconfig.Settings
+	writer io.Writer
+}
+
+func Run(ctx context.Context, args Args) (err error) {
+	if args.writer == nil {
+		args.writer = os.Stdout
+	}
+	if args.Store == nil {
+		cfg, err := args.AWS.Load(ctx)
+		if err != nil {
+			return fmt.Errorf("cannot load AWS config: %w", err)
+		}
+		args.Store, err = db.NewMetricStoreFromConfig(cfg, args.TableName, args.AWS.DynamoDBOptions)
+		if err != nil {
+			return fmt.Errorf("cannot create store: %w", err)
+		}
+	}
+	switch args.Action {
+	case ActionList:
+		return list(ctx, args)
+	case ActionGet:
+		return get(ctx, args)
+	case ActionSet:
+		return set(ctx, args, func(processor.Checkpoint) time.Time { return args.To })
+	case ActionRewind:
+		return set(ctx, args, func(cp processor.Checkpoint) time.Time { return cp.LastStart.Add(-args.By) })
+	case ActionDelete:
+		return remove(ctx, args)
+	}
+	return fmt.Errorf("unknown action %q", args.Action)
+}
+
+func writeCheckpoints(w io.Writer, cps ...processor.Checkpoint) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "METRIC\tPOSITION\tVERSION")
+	for _, cp := range cps {
+		fmt.Fprintf(tw, "%s\t%s\t%d\n", cp.Key, cp.LastStart.Format(time.RFC3339), cp.Version)
+	}
+	return tw.Flush()
+}
+
+func list(ctx context.Context, args Args) error {
+	cps, err := args.Store.ListCheckpoints(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list checkpoints: %w", err)
+	}
+	return writeCheckpoints(args.writer, cps...)
+}
+
+func get(ctx context.Context, args Args) error {
+	cp, ok, err := args.Store.GetCheckpoint(ctx, args.Key)
+	if err != nil {
+		return fmt.Errorf("failed to get checkpoint: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("no checkpoint found for %q", args.Key)
+	}
+	return writeCheckpoints(args.writer, cp)
+}
+
+func set(ctx context.Context, args Args, position func(processor.Checkpoint) time.Time) error {
+	cp, ok, err := args.Store.GetCheckpoint(ctx, args.Key)
+	if err != nil {
+		return fmt.Errorf("failed to get checkpoint: %w", err)
+	}
+	if !ok && args.Action == ActionRewind {
+		return fmt.Errorf("no checkpoint found for %q to rewind", args.Key)
+	}
+	to := position(cp).UTC()
+	from := "(none)"
+	if ok {
+		from = cp.LastStart.Format(time.RFC3339)
+	}
+	if args.DryRun {
+		fmt.Fprintf(args.writer, "would set %s from %s to %s\n", args.Key, from, to.Format(time.RFC3339))
+		return nil
+	}
+	// Only set the checkpoint if a processor hasn't moved it since it was read.
+	updated, err := args.Store.SetCheckpoint(ctx, args.Key, to, cp.Version)
+	if err != nil {
+		return fmt.Errorf("failed to set checkpoint: %w", err)
+	}
+	fmt.Fprintf(args.writer, "set %s from %s to %s (version %d)\n", args.Key, from, updated.LastStart.Format(time.RFC3339), updated.Version)
+	return nil
+}
+
+func remove(ctx context.Context, args Args) error {
+	cp, ok, err := args.Store.GetCheckpoint(ctx, args.Key)
+	if err != nil {
+		return fmt.Errorf("failed to get checkpoint: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("no checkpoint found for %q", args.Key)
+	}
+	if args.DryRun {
+		fmt.Fprintf(args.writer, "would delete %s at %s\n", args.Key, cp.LastStart.Format(time.RFC3339))
+		return nil
+	}
+	if err = args.Store.DeleteCheckpoint(ctx, args.Key); err != nil {
+		return fmt.Errorf("failed to delete checkpoint: %w", err)
+	}
+	fmt.Fprintf(args.writer, "deleted %s at %s\n", args.Key, cp.LastStart.Format(time.RFC3339))
+	return nil
+}
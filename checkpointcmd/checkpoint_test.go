@@ -0,0 +1,170 @@
+package checkpointcmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/a-h/cwexport/processor"
+)
+
+type mockCheckpointStore struct {
+	checkpoints map[string]processor.Checkpoint
+	// movedAfterGet simulates a processor moving the checkpoint after it's read.
+	movedAfterGet bool
+}
+
+func (s *mockCheckpointStore) ListCheckpoints(ctx context.Context) (cps []processor.Checkpoint, err error) {
+	for _, cp := range s.checkpoints {
+		cps = append(cps, cp)
+	}
+	return
+}
+
+func (s *mockCheckpointStore) GetCheckpoint(ctx context.Context, key string) (cp processor.Checkpoint, ok bool, err error) {
+	cp, ok = s.checkpoints[key]
+	if ok && s.movedAfterGet {
+		moved := cp
+		moved.LastStart = moved.LastStart.Add(time.Minute)
+		moved.Version++
+		s.checkpoints[key] = moved
+	}
+	return
+}
+
+func (s *mockCheckpointStore) SetCheckpoint(ctx context.Context, key string, lastStart time.Time, expectedVersion int64) (cp processor.Checkpoint, err error) {
+	cp = s.checkpoints[key]
+	if cp.Version != expectedVersion {
+		return cp, fmt.Errorf("%w: the checkpoint has been modified since version %d", processor.ErrCheckpointConflict, expectedVersion)
+	}
+	cp.Key = key
+	cp.LastStart = lastStart
+	cp.Version++
+	s.checkpoints[key] = cp
+	return
+}
+
+func (s *mockCheckpointStore) DeleteCheckpoint(ctx context.Context, key string) (err error) {
+	delete(s.checkpoints, key)
+	return
+}
+
+func TestCheckpoint(t *testing.T) {
+	key := "ns/logins/Sum/60"
+	position := time.Date(2022, time.January, 2, 0, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		desc             string
+		args             Args
+		expectedOutput   string
+		expectedPosition time.Time
+		expectedDeleted  bool
+		expectedErr      bool
+	}{
+		{
+			desc:             "get shows the checkpoint",
+			args:             Args{Action: ActionGet, Key: key},
+			expectedOutput:   "2022-01-02T00:00:00Z",
+			expectedPosition: position,
+		},
+		{
+			desc:        "get returns an error for a missing checkpoint",
+			args:        Args{Action: ActionGet, Key: "missing"},
+			expectedErr: true,
+		},
+		{
+			desc:             "set moves the checkpoint",
+			args:             Args{Action: ActionSet, Key: key, To: position.Add(-48 * time.Hour)},
+			expectedOutput:   "set ns/logins/Sum/60 from 2022-01-02T00:00:00Z to 2021-12-31T00:00:00Z (version 2)",
+			expectedPosition: position.Add(-48 * time.Hour),
+		},
+		{
+			desc:             "rewind moves the checkpoint backwards",
+			args:             Args{Action: ActionRewind, Key: key, By: time.Hour},
+			expectedOutput:   "set ns/logins/Sum/60 from 2022-01-02T00:00:00Z to 2022-01-01T23:00:00Z (version 2)",
+			expectedPosition: position.Add(-time.Hour),
+		},
+		{
+			desc:             "rewind in dry run mode doesn't change the checkpoint",
+			args:             Args{Action: ActionRewind, Key: key, By: time.Hour, DryRun: true},
+			expectedOutput:   "would set ns/logins/Sum/60 from 2022-01-02T00:00:00Z to 2022-01-01T23:00:00Z",
+			expectedPosition: position,
+		},
+		{
+			desc:        "rewind returns an error for a missing checkpoint",
+			args:        Args{Action: ActionRewind, Key: "missing", By: time.Hour},
+			expectedErr: true,
+		},
+		{
+			desc:            "delete removes the checkpoint",
+			args:            Args{Action: ActionDelete, Key: key},
+			expectedOutput:  "deleted ns/logins/Sum/60 at 2022-01-02T00:00:00Z",
+			expectedDeleted: true,
+		},
+		{
+			desc:             "delete in dry run mode doesn't remove the checkpoint",
+			args:             Args{Action: ActionDelete, Key: key, DryRun: true},
+			expectedOutput:   "would delete ns/logins/Sum/60 at 2022-01-02T00:00:00Z",
+			expectedPosition: position,
+		},
+		{
+			desc:             "list shows all checkpoints",
+			args:             Args{Action: ActionList},
+			expectedOutput:   "ns/logins/Sum/60  2022-01-02T00:00:00Z  1",
+			expectedPosition: position,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			store := &mockCheckpointStore{
+				checkpoints: map[string]processor.Checkpoint{
+					key: {Key: key, LastStart: position, Version: 1},
+				},
+			}
+			var w strings.Builder
+			tC.args.writer = &w
+			tC.args.Store = store
+			err := Run(context.Background(), tC.args)
+			if tC.expectedErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !strings.Contains(w.String(), tC.expectedOutput) {
+				t.Errorf("expected output to contain %q, got %q", tC.expectedOutput, w.String())
+			}
+			cp, ok := store.checkpoints[key]
+			if ok == tC.expectedDeleted {
+				t.Fatalf("expected deleted=%v", tC.expectedDeleted)
+			}
+			if ok && !cp.LastStart.Equal(tC.expectedPosition) {
+				t.Errorf("expected position %v, got %v", tC.expectedPosition, cp.LastStart)
+			}
+		})
+	}
+}
+
+func TestCheckpointConflict(t *testing.T) {
+	key := "ns/logins/Sum/60"
+	position := time.Date(2022, time.January, 2, 0, 0, 0, 0, time.UTC)
+	store := &mockCheckpointStore{
+		checkpoints: map[string]processor.Checkpoint{
+			key: {Key: key, LastStart: position, Version: 1},
+		},
+		movedAfterGet: true,
+	}
+	var w strings.Builder
+	err := Run(context.Background(), Args{Action: ActionRewind, Key: key, By: time.Hour, writer: &w, Store: store})
+	if !errors.Is(err, processor.ErrCheckpointConflict) {
+		t.Fatalf("expected a checkpoint conflict, got %v", err)
+	}
+	if cp := store.checkpoints[key]; !cp.LastStart.Equal(position.Add(time.Minute)) {
+		t.Errorf("expected the checkpoint moved by the processor to be kept, got %v", cp.LastStart)
+	}
+}
@@ -0,0 +1,238 @@
+// Package configfile reads configuration files in TOML, YAML or JSON, chosen by the file extension.
+// String values can use env variables, e.g. ${TEAM}, and a file can include other files, e.g. to
+// share groups of metrics.
+package configfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// IncludeKey is the top level key that lists the files to include, relative to the including file.
+// The paths can be glob patterns, e.g. teams/*.yaml.
+const IncludeKey = "Include"
+
+// Decode reads the file, and its includes, into v. Keys are matched to the fields of v without
+// regard to case, as encoding/json does.
+func Decode(fileName string, v interface{}) error {
+	doc, err := read(fileName, nil)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("%s: %w", fileName, err)
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", fileName, err)
+	}
+	return nil
+}
+
+// read reads the file, and merges it over the files it includes. The including files are used to
+// detect include cycles.
+func read(fileName string, including []string) (doc map[string]interface{}, err error) {
+	abs, err := filepath.Abs(fileName)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range including {
+		if f == abs {
+			return nil, fmt.Errorf("%s: include cycle: %s", fileName, strings.Join(append(including, abs), " -> "))
+		}
+	}
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if doc, err = parse(fileName, data); err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	includes, err := takeIncludes(doc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	merged := map[string]interface{}{}
+	for _, pattern := range includes {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(fileName), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid include %q: %w", fileName, pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%s: include %q matched no files", fileName, pattern)
+		}
+		for _, m := range matches {
+			included, err := read(m, append(including, abs))
+			if err != nil {
+				return nil, err
+			}
+			merged = merge(merged, included)
+		}
+	}
+	return merge(merged, doc), nil
+}
+
+// parse parses the data in the format given by the file extension, and interpolates env variables
+// in its string values.
+func parse(fileName string, data []byte) (doc map[string]interface{}, err error) {
+	var v interface{}
+	switch ext := strings.ToLower(filepath.Ext(fileName)); ext {
+	case ".toml":
+		var m map[string]interface{}
+		_, err = toml.Decode(string(data), &m)
+		v = m
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &v)
+	case ".json":
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		err = d.Decode(&v)
+	default:
+		return nil, fmt.Errorf("unsupported file extension %q, expected .toml, .yaml, .yml or .json", ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		// The file is empty.
+		return map[string]interface{}{}, nil
+	}
+	v, err = normalize(v)
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a table of settings at the top level, got %T", v)
+	}
+	return doc, nil
+}
+
+// normalize converts the maps and slices of each format to map[string]interface{} and
+// []interface{}, and interpolates env variables in string values.
+func normalize(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return Interpolate(v)
+	case map[string]interface{}:
+		op := make(map[string]interface{}, len(v))
+		for k, vv := range v {
+			nv, err := normalize(vv)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			op[k] = nv
+		}
+		return op, nil
+	case map[interface{}]interface{}:
+		op := make(map[string]interface{}, len(v))
+		for k, vv := range v {
+			nv, err := normalize(vv)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %w", k, err)
+			}
+			op[fmt.Sprint(k)] = nv
+		}
+		return op, nil
+	case []map[string]interface{}:
+		op := make([]interface{}, len(v))
+		for i, vv := range v {
+			nv, err := normalize(vv)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			op[i] = nv
+		}
+		return op, nil
+	case []interface{}:
+		op := make([]interface{}, len(v))
+		for i, vv := range v {
+			nv, err := normalize(vv)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			op[i] = nv
+		}
+		return op, nil
+	}
+	return v, nil
+}
+
+// takeIncludes removes the include key from the document, and returns its paths.
+func takeIncludes(doc map[string]interface{}) (includes []string, err error) {
+	for k, v := range doc {
+		if !strings.EqualFold(k, IncludeKey) {
+			continue
+		}
+		delete(doc, k)
+		switch v := v.(type) {
+		case string:
+			includes = append(includes, v)
+		case []interface{}:
+			for _, vv := range v {
+				s, ok := vv.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s: expected a list of paths, got %v", k, vv)
+				}
+				includes = append(includes, s)
+			}
+		default:
+			return nil, fmt.Errorf("%s: expected a list of paths, got %v", k, v)
+		}
+	}
+	return includes, nil
+}
+
+// merge merges the override over the base document. Lists are concatenated, so that the metrics and
+// groups of both are kept, tables are merged, and any other value in the override replaces the base
+// value. Keys are matched without regard to case, and the override's key is kept.
+func merge(base, override map[string]interface{}) map[string]interface{} {
+	op := make(map[string]interface{}, len(base)+len(override))
+	for k, v := range base {
+		op[k] = v
+	}
+	for k, v := range override {
+		bk, bv, ok := find(op, k)
+		if !ok {
+			op[k] = v
+			continue
+		}
+		delete(op, bk)
+		switch v := v.(type) {
+		case []interface{}:
+			if bl, isList := bv.([]interface{}); isList {
+				op[k] = append(append([]interface{}{}, bl...), v...)
+				continue
+			}
+		case map[string]interface{}:
+			if bm, isMap := bv.(map[string]interface{}); isMap {
+				op[k] = merge(bm, v)
+				continue
+			}
+		}
+		op[k] = v
+	}
+	return op
+}
+
+func find(m map[string]interface{}, key string) (k string, v interface{}, ok bool) {
+	if v, ok = m[key]; ok {
+		return key, v, ok
+	}
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return k, v, true
+		}
+	}
+	return "", nil, false
+}
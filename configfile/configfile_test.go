@@ -0,0 +1,254 @@
+package configfile
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testMetric struct {
+	Namespace  string
+	MetricName string
+	Period     int
+	Dimensions map[string]string
+	StartTime  time.Time
+}
+
+type testGroup struct {
+	Region string
+	Metric []testMetric
+}
+
+type testAlarms struct {
+	Email    string
+	Disabled *bool
+}
+
+type testConfig struct {
+	Region string
+	Alarms testAlarms
+	Metric []testMetric
+	Group  []testGroup
+}
+
+func writeFiles(t *testing.T, files map[string]string) (dir string) {
+	dir = t.TempDir()
+	for name, content := range files {
+		fileName := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fileName), 0o755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(fileName, []byte(content), 0o644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+	return dir
+}
+
+func TestDecodeFormats(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"config.toml": `
+Region = "eu-west-1"
+[alarms]
+email = "ops@example.com"
+[[metric]]
+Namespace = "AWS/Lambda"
+MetricName = "Invocations"
+Period = 5
+StartTime = 2021-03-21T09:00:00Z
+[metric.Dimensions]
+FunctionName = "pricing"
+`,
+		"config.yaml": `
+Region: eu-west-1
+alarms:
+  email: ops@example.com
+metric:
+  - Namespace: AWS/Lambda
+    MetricName: Invocations
+    Period: 5
+    StartTime: 2021-03-21T09:00:00Z
+    Dimensions:
+      FunctionName: pricing
+`,
+		"config.yml": `
+region: eu-west-1
+Alarms: {Email: ops@example.com}
+Metric: [{namespace: AWS/Lambda, metricName: Invocations, period: 5, startTime: "2021-03-21T09:00:00Z", dimensions: {FunctionName: pricing}}]
+`,
+		"config.json": `{
+  "$schema": "config.schema.json",
+  "Region": "eu-west-1",
+  "Alarms": {"Email": "ops@example.com"},
+  "Metric": [
+    {
+      "Namespace": "AWS/Lambda",
+      "MetricName": "Invocations",
+      "Period": 5,
+      "StartTime": "2021-03-21T09:00:00Z",
+      "Dimensions": {"FunctionName": "pricing"}
+    }
+  ]
+}`,
+	})
+	expected := testConfig{
+		Region: "eu-west-1",
+		Alarms: testAlarms{Email: "ops@example.com"},
+		Metric: []testMetric{
+			{
+				Namespace:  "AWS/Lambda",
+				MetricName: "Invocations",
+				Period:     5,
+				Dimensions: map[string]string{"FunctionName": "pricing"},
+				StartTime:  time.Date(2021, time.March, 21, 9, 0, 0, 0, time.UTC),
+			},
+		},
+	}
+	for _, name := range []string{"config.toml", "config.yaml", "config.yml", "config.json"} {
+		t.Run(name, func(t *testing.T) {
+			var actual testConfig
+			if err := Decode(filepath.Join(dir, name), &actual); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !actual.Metric[0].StartTime.Equal(expected.Metric[0].StartTime) {
+				t.Errorf("expected start time %v, got %v", expected.Metric[0].StartTime, actual.Metric[0].StartTime)
+			}
+			actual.Metric[0].StartTime = expected.Metric[0].StartTime
+			if !reflect.DeepEqual(actual, expected) {
+				t.Errorf("expected %+v, got %+v", expected, actual)
+			}
+		})
+	}
+}
+
+func TestDecodeIncludes(t *testing.T) {
+	t.Setenv("CWEXPORT_TEST_TEAM", "payments")
+	dir := writeFiles(t, map[string]string{
+		"config.yaml": `
+include:
+  - defaults.toml
+  - teams/*.yaml
+alarms:
+  email: ${CWEXPORT_TEST_TEAM}@example.com
+metric:
+  - namespace: AWS/Lambda
+    metricName: Invocations
+`,
+		"defaults.toml": `
+Region = "eu-west-1"
+[alarms]
+Email = "platform@example.com"
+Disabled = true
+`,
+		"teams/a.yaml": `
+group:
+  - region: us-east-1
+    metric:
+      - namespace: ${CWEXPORT_TEST_TEAM}
+        metricName: Completed
+`,
+		"teams/b.json": `{"Group": [{"Region": "ignored, since it doesn't match the pattern"}]}`,
+		"teams/c.yaml": `
+group:
+  - region: ${CWEXPORT_TEST_REGION:-eu-west-2}
+    metric:
+      - namespace: $${literal}
+        metricName: Failed
+`,
+	})
+	var actual testConfig
+	if err := Decode(filepath.Join(dir, "config.yaml"), &actual); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	disabled := true
+	expected := testConfig{
+		Region: "eu-west-1",
+		Alarms: testAlarms{Email: "payments@example.com", Disabled: &disabled},
+		Metric: []testMetric{
+			{Namespace: "AWS/Lambda", MetricName: "Invocations"},
+		},
+		Group: []testGroup{
+			{Region: "us-east-1", Metric: []testMetric{{Namespace: "payments", MetricName: "Completed"}}},
+			{Region: "eu-west-2", Metric: []testMetric{{Namespace: "${literal}", MetricName: "Failed"}}},
+		},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"config.ini":      `Region = eu-west-1`,
+		"cycle-a.toml":    `Include = ["cycle-b.yaml"]`,
+		"cycle-b.yaml":    `include: cycle-a.toml`,
+		"missing.json":    `{"Include": ["teams/*.yaml"]}`,
+		"invalid.yaml":    `include: [1]`,
+		"list.json":       `[]`,
+		"unset-env.toml":  `Region = "${CWEXPORT_TEST_UNSET}"`,
+		"syntax-err.json": `{"Region": }`,
+	})
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{name: "config.ini", expected: `unsupported file extension ".ini"`},
+		{name: "cycle-a.toml", expected: "include cycle"},
+		{name: "missing.json", expected: "matched no files"},
+		{name: "invalid.yaml", expected: "expected a list of paths"},
+		{name: "list.json", expected: "expected a table of settings"},
+		{name: "unset-env.toml", expected: "env variable CWEXPORT_TEST_UNSET is not set"},
+		{name: "syntax-err.json", expected: "syntax-err.json: invalid character"},
+		{name: "not-found.toml", expected: "no such file"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var c testConfig
+			err := Decode(filepath.Join(dir, test.name), &c)
+			if err == nil || !strings.Contains(err.Error(), test.expected) {
+				t.Errorf("expected an error containing %q, got %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	t.Setenv("CWEXPORT_TEST_A", "a")
+	t.Setenv("CWEXPORT_TEST_EMPTY", "")
+	tests := []struct {
+		input    string
+		expected string
+		err      string
+	}{
+		{input: "no variables", expected: "no variables"},
+		{input: "$5 and $HOME are literal", expected: "$5 and $HOME are literal"},
+		{input: "${CWEXPORT_TEST_A}/${CWEXPORT_TEST_A}", expected: "a/a"},
+		{input: "${CWEXPORT_TEST_EMPTY}", expected: ""},
+		{input: "${CWEXPORT_TEST_EMPTY:-default}", expected: "default"},
+		{input: "${CWEXPORT_TEST_UNSET:-}", expected: ""},
+		{input: "${CWEXPORT_TEST_A:-default}", expected: "a"},
+		{input: "$${CWEXPORT_TEST_A}", expected: "${CWEXPORT_TEST_A}"},
+		{input: "${CWEXPORT_TEST_UNSET}", err: "env variable CWEXPORT_TEST_UNSET is not set"},
+		{input: "${not a name}", err: "invalid variable"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			actual, err := Interpolate(test.input)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("expected an error containing %q, got %q, %v", test.err, actual, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if actual != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package configfile
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// variableExpression matches ${NAME} and ${NAME:-default}, and the $${ escape.
+var variableExpression = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-[^}]*)?\}`)
+
+// Interpolate replaces ${NAME} with the value of the NAME env variable, and ${NAME:-default} with
+// the default if NAME is unset or empty. It's an error for a variable without a default to be unset.
+// Use $${ for a literal ${.
+func Interpolate(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var missing []string
+	op := variableExpression.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "$${" {
+			return "${"
+		}
+		groups := variableExpression.FindStringSubmatch(match)
+		name, def := groups[1], groups[2]
+		value, ok := os.LookupEnv(name)
+		if def != "" {
+			if value == "" {
+				return strings.TrimPrefix(def, ":-")
+			}
+			return value
+		}
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return s, fmt.Errorf("env variable %s is not set", strings.Join(missing, ", "))
+	}
+	if rest := variableExpression.ReplaceAllString(s, ""); strings.Contains(rest, "${") {
+		return s, fmt.Errorf("invalid variable in %q, expected ${NAME} or ${NAME:-default}", s)
+	}
+	return op, nil
+}
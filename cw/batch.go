@@ -0,0 +1,112 @@
+package cw
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// MaxBatchSize is the maximum number of metrics in a GetMetricData request.
+const MaxBatchSize = 500
+
+// batchTimeout limits how long a batch can take. Batches aren't sent using the context of any one
+// request, so that a request that gives up doesn't cancel the others in its batch.
+const batchTimeout = 30 * time.Second
+
+// NewBatcher creates a Batcher that waits for up to the given duration to collect requests for the
+// same time range before sending them to CloudWatch.
+func NewBatcher(client cloudwatch.GetMetricDataAPIClient, wait time.Duration) *Batcher {
+	return &Batcher{
+		client:  client,
+		wait:    wait,
+		pending: make(map[timeRange]*batch),
+	}
+}
+
+// NewBatcherFromConfig creates a Batcher from AWS config. The optFns can be used to override the
+// client options, e.g. to set an endpoint resolver.
+func NewBatcherFromConfig(config aws.Config, wait time.Duration, optFns ...func(*cloudwatch.Options)) *Batcher {
+	return NewBatcher(cloudwatch.NewFromConfig(config, optFns...), wait)
+}
+
+// Batcher gets samples like Cloudwatch, but combines concurrent requests for the same time range
+// into a single GetMetricData request, so that processing many metrics at once makes fewer calls.
+type Batcher struct {
+	client cloudwatch.GetMetricDataAPIClient
+	wait   time.Duration
+	// accountId is the source account of the metrics, when using cross-account observability.
+	accountId string
+	m         sync.Mutex
+	pending   map[timeRange]*batch
+}
+
+type timeRange struct {
+	start, end int64
+}
+
+type batch struct {
+	start, end time.Time
+	queries    []types.MetricDataQuery
+	done       chan struct{}
+	samples    map[string][]Sample
+	err        error
+}
+
+func (b *Batcher) GetSamples(ctx context.Context, metric *types.MetricStat, start time.Time, end time.Time) (samples []Sample, err error) {
+	key := timeRange{start: start.UnixNano(), end: end.UnixNano()}
+	b.m.Lock()
+	bt, ok := b.pending[key]
+	if !ok {
+		bt = &batch{
+			start: start,
+			end:   end,
+			done:  make(chan struct{}),
+		}
+		b.pending[key] = bt
+		time.AfterFunc(b.wait, func() {
+			b.m.Lock()
+			// Full batches have already been removed and sent.
+			full := b.pending[key] != bt
+			if !full {
+				delete(b.pending, key)
+			}
+			b.m.Unlock()
+			if !full {
+				b.send(bt)
+			}
+		})
+	}
+	id := fmt.Sprintf("m%d", len(bt.queries))
+	bt.queries = append(bt.queries, types.MetricDataQuery{
+		Id:         aws.String(id),
+		AccountId:  optionalString(b.accountId),
+		MetricStat: metric,
+		ReturnData: aws.Bool(true),
+	})
+	if len(bt.queries) == MaxBatchSize {
+		// Start a new batch for any further requests.
+		delete(b.pending, key)
+		go b.send(bt)
+	}
+	b.m.Unlock()
+
+	select {
+	case <-bt.done:
+		return bt.samples[id], bt.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// send sends the batch, once it has been removed from the pending batches.
+func (b *Batcher) send(bt *batch) {
+	ctx, cancel := context.WithTimeout(context.Background(), batchTimeout)
+	defer cancel()
+	bt.samples, bt.err = getSamples(ctx, b.client, bt.start, bt.end, bt.queries)
+	close(bt.done)
+}
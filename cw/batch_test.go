@@ -0,0 +1,119 @@
+package cw
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// mockClient returns a sample for each query, with the value set to the query's period.
+type mockClient struct {
+	m        sync.Mutex
+	requests []*cloudwatch.GetMetricDataInput
+}
+
+func (c *mockClient) GetMetricData(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error) {
+	c.m.Lock()
+	c.requests = append(c.requests, params)
+	c.m.Unlock()
+	var output cloudwatch.GetMetricDataOutput
+	for _, q := range params.MetricDataQueries {
+		output.MetricDataResults = append(output.MetricDataResults, types.MetricDataResult{
+			Id:         q.Id,
+			Timestamps: []time.Time{*params.StartTime},
+			Values:     []float64{float64(*q.MetricStat.Period)},
+		})
+	}
+	return &output, nil
+}
+
+func metricWithPeriod(period int32) *types.MetricStat {
+	return &types.MetricStat{
+		Metric: &types.Metric{
+			Namespace:  aws.String("ns"),
+			MetricName: aws.String(fmt.Sprintf("metric%d", period)),
+		},
+		Period: aws.Int32(period),
+		Stat:   aws.String("Sum"),
+	}
+}
+
+func TestBatcher(t *testing.T) {
+	start := time.Date(2022, time.January, 1, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name             string
+		metricCount      int
+		ranges           int
+		expectedRequests int
+	}{
+		{
+			name:             "a single request is sent on its own",
+			metricCount:      1,
+			ranges:           1,
+			expectedRequests: 1,
+		},
+		{
+			name:             "concurrent requests for the same time range are combined",
+			metricCount:      20,
+			ranges:           1,
+			expectedRequests: 1,
+		},
+		{
+			name:             "requests for different time ranges are sent separately",
+			metricCount:      20,
+			ranges:           2,
+			expectedRequests: 2,
+		},
+		{
+			name:             "batches are limited to the maximum batch size",
+			metricCount:      MaxBatchSize + 1,
+			ranges:           1,
+			expectedRequests: 2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &mockClient{}
+			b := NewBatcher(client, 50*time.Millisecond)
+			var wg sync.WaitGroup
+			for r := 0; r < test.ranges; r++ {
+				rangeStart := start.Add(time.Duration(r) * time.Minute)
+				for i := 1; i <= test.metricCount; i++ {
+					wg.Add(1)
+					go func(period int32) {
+						defer wg.Done()
+						samples, err := b.GetSamples(context.Background(), metricWithPeriod(period), rangeStart, rangeStart.Add(time.Minute))
+						if err != nil {
+							t.Errorf("unexpected error: %v", err)
+							return
+						}
+						if len(samples) != 1 || samples[0].Value != float64(period) || !samples[0].Time.Equal(rangeStart) {
+							t.Errorf("expected the sample of metric %d at %v, got %v", period, rangeStart, samples)
+						}
+					}(int32(i))
+				}
+			}
+			wg.Wait()
+			if len(client.requests) != test.expectedRequests {
+				t.Errorf("expected %d requests, got %d", test.expectedRequests, len(client.requests))
+			}
+		})
+	}
+}
+
+func TestBatcherCancellation(t *testing.T) {
+	b := NewBatcher(&mockClient{}, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Date(2022, time.January, 1, 9, 0, 0, 0, time.UTC)
+	_, err := b.GetSamples(ctx, metricWithPeriod(60), start, start.Add(time.Minute))
+	if err != context.Canceled {
+		t.Fatalf("expected the request to be cancelled, got %v", err)
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 )
@@ -16,32 +15,48 @@ type Sample struct {
 	Value float64   `json:"value"`
 }
 
+// New creates a Cloudwatch that reads samples using the given client.
+func New(client cloudwatch.GetMetricDataAPIClient) Cloudwatch {
+	return Cloudwatch{
+		client: client,
+	}
+}
+
+// NewFromConfig creates a Cloudwatch from AWS config. The optFns can be used to override
+// the client options, e.g. to set an endpoint resolver.
+func NewFromConfig(config aws.Config, optFns ...func(*cloudwatch.Options)) Cloudwatch {
+	return New(cloudwatch.NewFromConfig(config, optFns...))
+}
+
 type Cloudwatch struct {
+	client cloudwatch.GetMetricDataAPIClient
+	// accountId is the source account of the metrics, when using cross-account observability.
+	accountId string
 }
 
-func (Cloudwatch) GetSamples(metric *types.MetricStat, start time.Time, end time.Time) (samples []Sample, err error) {
-	ctx := context.Background()
-	cfg, err := config.LoadDefaultConfig(ctx)
-	if err != nil {
-		err = fmt.Errorf("unable to load SDK config: %w", err)
-		return
-	}
+func (c Cloudwatch) GetSamples(ctx context.Context, metric *types.MetricStat, start time.Time, end time.Time) (samples []Sample, err error) {
+	results, err := getSamples(ctx, c.client, start, end, []types.MetricDataQuery{
+		{
+			Id:         aws.String("a"),
+			AccountId:  optionalString(c.accountId),
+			MetricStat: metric,
+			ReturnData: aws.Bool(true),
+		},
+	})
+	return results["a"], err
+}
 
-	cw := cloudwatch.NewFromConfig(cfg)
+// getSamples runs the queries, and returns the samples of each query, keyed by the query ID.
+func getSamples(ctx context.Context, client cloudwatch.GetMetricDataAPIClient, start, end time.Time, queries []types.MetricDataQuery) (samples map[string][]Sample, err error) {
 	params := &cloudwatch.GetMetricDataInput{
-		StartTime: aws.Time(start),
-		EndTime:   aws.Time(end),
-		MetricDataQueries: []types.MetricDataQuery{
-			{
-				Id:         aws.String("a"),
-				MetricStat: metric,
-				ReturnData: aws.Bool(true),
-			},
-		},
-		ScanBy: types.ScanByTimestampAscending,
+		StartTime:         aws.Time(start),
+		EndTime:           aws.Time(end),
+		MetricDataQueries: queries,
+		ScanBy:            types.ScanByTimestampAscending,
 	}
 
-	paginator := cloudwatch.NewGetMetricDataPaginator(cw, params)
+	samples = make(map[string][]Sample, len(queries))
+	paginator := cloudwatch.NewGetMetricDataPaginator(client, params)
 	for paginator.HasMorePages() {
 		var md *cloudwatch.GetMetricDataOutput
 		md, err = paginator.NextPage(ctx)
@@ -50,8 +65,9 @@ func (Cloudwatch) GetSamples(metric *types.MetricStat, start time.Time, end time
 			return
 		}
 		for _, m := range md.MetricDataResults {
+			id := aws.ToString(m.Id)
 			for i := 0; i < len(m.Timestamps); i++ {
-				samples = append(samples, Sample{
+				samples[id] = append(samples[id], Sample{
 					Time:  m.Timestamps[i],
 					Value: m.Values[i],
 				})
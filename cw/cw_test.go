@@ -0,0 +1,114 @@
+package cw
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+const getMetricDataResponse = `<GetMetricDataResponse xmlns="http://monitoring.amazonaws.com/doc/2010-08-01/">
+  <GetMetricDataResult>
+    <MetricDataResults>
+      <member>
+        <Id>a</Id>
+        <StatusCode>Complete</StatusCode>
+        <Timestamps>
+          <member>%s</member>
+        </Timestamps>
+        <Values>
+          <member>%d</member>
+        </Values>
+      </member>
+    </MetricDataResults>
+    %s
+  </GetMetricDataResult>
+  <ResponseMetadata>
+    <RequestId>c3f4a1d6-0000-0000-0000-000000000000</RequestId>
+  </ResponseMetadata>
+</GetMetricDataResponse>`
+
+func newTestCloudwatch(url string) Cloudwatch {
+	return NewFromConfig(aws.Config{
+		Region:       "eu-pluto-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("fake", "accessKeyId", "secretKeyId"),
+		Retryer:      func() aws.Retryer { return aws.NopRetryer{} },
+		BaseEndpoint: aws.String(url),
+	})
+}
+
+var testMetric = &types.MetricStat{
+	Metric: &types.Metric{
+		Namespace:  aws.String("ns"),
+		MetricName: aws.String("metricA"),
+	},
+	Period: aws.Int32(60),
+	Stat:   aws.String("Sum"),
+}
+
+func TestGetSamples(t *testing.T) {
+	start := time.Date(2022, time.January, 1, 9, 0, 0, 0, time.UTC)
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse request: %v", err)
+		}
+		if action := r.Form.Get("Action"); action != "GetMetricData" {
+			t.Errorf("expected GetMetricData request, got %q", action)
+		}
+		if ns := r.Form.Get("MetricDataQueries.member.1.MetricStat.Metric.Namespace"); ns != "ns" {
+			t.Errorf("expected the metric namespace to be sent, got %q", ns)
+		}
+		requests++
+		// Return the first page with a token, then the last page.
+		nextToken := "<NextToken>page2</NextToken>"
+		if r.Form.Get("NextToken") == "page2" {
+			nextToken = ""
+		}
+		ts := start.Add(time.Duration(requests-1) * time.Minute).Format(time.RFC3339)
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprintf(w, getMetricDataResponse, ts, requests, nextToken)
+	}))
+	defer server.Close()
+
+	samples, err := newTestCloudwatch(server.URL).GetSamples(context.Background(), testMetric, start, start.Add(2*time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("expected both pages to be requested, got %d requests", requests)
+	}
+	expected := []Sample{
+		{Time: start, Value: 1},
+		{Time: start.Add(time.Minute), Value: 2},
+	}
+	if len(samples) != len(expected) {
+		t.Fatalf("expected %d samples, got %d", len(expected), len(samples))
+	}
+	for i := range expected {
+		if !samples[i].Time.Equal(expected[i].Time) || samples[i].Value != expected[i].Value {
+			t.Errorf("sample %d: expected %v, got %v", i, expected[i], samples[i])
+		}
+	}
+}
+
+func TestGetSamplesCancellation(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("unexpected request after the context was cancelled")
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Date(2022, time.January, 1, 9, 0, 0, 0, time.UTC)
+	_, err := newTestCloudwatch(server.URL).GetSamples(ctx, testMetric, start, start.Add(time.Minute))
+	if err == nil {
+		t.Fatal("expected an error when the context is cancelled")
+	}
+}
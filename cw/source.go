@@ -0,0 +1,140 @@
+package cw
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// Source is where metrics are read from. The zero Source reads from the default account and region.
+type Source struct {
+	// Region to read metrics from, instead of the default region.
+	Region string `json:",omitempty"`
+	// RoleArn is a role to assume to read metrics, e.g. in another account.
+	RoleArn string `json:",omitempty"`
+	// ExternalId is passed when assuming RoleArn, if the role's trust policy requires it.
+	ExternalId string `json:",omitempty"`
+	// AccountId reads metrics from a source account that is linked to this monitoring account by
+	// CloudWatch cross-account observability.
+	AccountId string `json:",omitempty"`
+}
+
+// SourcedMetric is a metric, and the source to read it from.
+type SourcedMetric struct {
+	types.MetricStat
+	Source
+	// StartTime is the time to start exporting from, if the metric has no checkpoint. If it's
+	// nil, the processor's default is used.
+	StartTime *time.Time `json:",omitempty"`
+}
+
+// Merge returns the source, with any unset values taken from the defaults.
+func (s Source) Merge(defaults Source) Source {
+	if s.Region == "" {
+		s.Region = defaults.Region
+	}
+	if s.RoleArn == "" {
+		s.RoleArn = defaults.RoleArn
+		if s.ExternalId == "" {
+			s.ExternalId = defaults.ExternalId
+		}
+	}
+	if s.AccountId == "" {
+		s.AccountId = defaults.AccountId
+	}
+	return s
+}
+
+var (
+	roleArnExpression   = regexp.MustCompile(`^arn:[a-z-]+:iam::(\d{12}):role/.+$`)
+	accountIdExpression = regexp.MustCompile(`^\d{12}$`)
+)
+
+// Validate returns messages describing any problems with the source.
+func (s Source) Validate() (messages []string) {
+	if s.RoleArn != "" && !roleArnExpression.MatchString(s.RoleArn) {
+		messages = append(messages, fmt.Sprintf("Invalid RoleArn %q, expected an IAM role ARN", s.RoleArn))
+	}
+	if s.ExternalId != "" && s.RoleArn == "" {
+		messages = append(messages, "ExternalId can only be used with RoleArn")
+	}
+	if s.AccountId != "" && !accountIdExpression.MatchString(s.AccountId) {
+		messages = append(messages, fmt.Sprintf("Invalid AccountId %q, expected a 12 digit account ID", s.AccountId))
+	}
+	return
+}
+
+// Account returns the account that metrics are read from, if it isn't the default account. That's
+// AccountId if it's set, otherwise the account of RoleArn.
+func (s Source) Account() string {
+	if s.AccountId != "" {
+		return s.AccountId
+	}
+	if m := roleArnExpression.FindStringSubmatch(s.RoleArn); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// Key identifies the source by its account and region, e.g. "123456789012/eu-west-1". It's empty for
+// the default account and region.
+func (s Source) Key() string {
+	var parts []string
+	if account := s.Account(); account != "" {
+		parts = append(parts, account)
+	}
+	if s.Region != "" {
+		parts = append(parts, s.Region)
+	}
+	return strings.Join(parts, "/")
+}
+
+// Config returns the AWS config to read metrics from the source with. The role is assumed using the
+// credentials of the given config.
+func (s Source) Config(config aws.Config) aws.Config {
+	sc := config.Copy()
+	if s.Region != "" {
+		sc.Region = s.Region
+	}
+	if s.RoleArn != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(config), s.RoleArn, func(o *stscreds.AssumeRoleOptions) {
+			if s.ExternalId != "" {
+				o.ExternalID = aws.String(s.ExternalId)
+			}
+			o.RoleSessionName = "cwexport"
+		})
+		sc.Credentials = aws.NewCredentialsCache(provider)
+	}
+	return sc
+}
+
+// NewFromSource creates a Cloudwatch that reads samples from the source, using AWS config. The optFns
+// can be used to override the client options, e.g. to set an endpoint resolver.
+func NewFromSource(config aws.Config, s Source, optFns ...func(*cloudwatch.Options)) Cloudwatch {
+	c := NewFromConfig(s.Config(config), optFns...)
+	c.accountId = s.AccountId
+	return c
+}
+
+// NewBatcherFromSource creates a Batcher that reads samples from the source, using AWS config. The
+// optFns can be used to override the client options, e.g. to set an endpoint resolver.
+func NewBatcherFromSource(config aws.Config, s Source, wait time.Duration, optFns ...func(*cloudwatch.Options)) *Batcher {
+	b := NewBatcherFromConfig(s.Config(config), wait, optFns...)
+	b.accountId = s.AccountId
+	return b
+}
+
+// optionalString returns nil for an empty string, so that it's left out of requests.
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
@@ -0,0 +1,63 @@
+package cw
+
+import "testing"
+
+func TestSourceValidate(t *testing.T) {
+	tests := []struct {
+		name             string
+		source           Source
+		expectedMessages int
+	}{
+		{name: "default"},
+		{name: "region", source: Source{Region: "eu-west-1"}},
+		{name: "role", source: Source{RoleArn: "arn:aws:iam::123456789012:role/cwexport", ExternalId: "abc"}},
+		{name: "account", source: Source{AccountId: "123456789012"}},
+		{name: "invalid role", source: Source{RoleArn: "cwexport"}, expectedMessages: 1},
+		{name: "external ID without role", source: Source{ExternalId: "abc"}, expectedMessages: 1},
+		{name: "invalid account", source: Source{AccountId: "1234"}, expectedMessages: 1},
+	}
+	for _, test := range tests {
+		if messages := test.source.Validate(); len(messages) != test.expectedMessages {
+			t.Errorf("%s: expected %d messages, got %v", test.name, test.expectedMessages, messages)
+		}
+	}
+}
+
+func TestSourceMerge(t *testing.T) {
+	defaults := Source{Region: "eu-west-1", RoleArn: "arn:aws:iam::123456789012:role/a", ExternalId: "a"}
+	tests := []struct {
+		name     string
+		source   Source
+		expected Source
+	}{
+		{name: "defaults", expected: defaults},
+		{name: "region", source: Source{Region: "us-east-1"}, expected: Source{Region: "us-east-1", RoleArn: defaults.RoleArn, ExternalId: "a"}},
+		{
+			name:     "a role doesn't use the default external ID",
+			source:   Source{RoleArn: "arn:aws:iam::210987654321:role/b"},
+			expected: Source{Region: "eu-west-1", RoleArn: "arn:aws:iam::210987654321:role/b"},
+		},
+	}
+	for _, test := range tests {
+		if actual := test.source.Merge(defaults); actual != test.expected {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestSourceKey(t *testing.T) {
+	tests := []struct {
+		source   Source
+		expected string
+	}{
+		{expected: ""},
+		{source: Source{Region: "eu-west-1"}, expected: "eu-west-1"},
+		{source: Source{RoleArn: "arn:aws:iam::123456789012:role/cwexport"}, expected: "123456789012"},
+		{source: Source{RoleArn: "arn:aws:iam::123456789012:role/cwexport", AccountId: "210987654321", Region: "eu-west-1"}, expected: "210987654321/eu-west-1"},
+	}
+	for _, test := range tests {
+		if actual := test.source.Key(); actual != test.expected {
+			t.Errorf("%+v: expected %q, got %q", test.source, test.expected, actual)
+		}
+	}
+}
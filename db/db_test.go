@@ -30,7 +30,9 @@ func init() {
 	if err != nil {
 		panic(fmt.Errorf("failed to load test aws config %w", err))
 	}
-	testClient = dynamodb.NewFromConfig(cfg, dynamodb.WithEndpointResolver(dynamodb.EndpointResolverFromURL(endpoint)))
+	testClient = dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		o.BaseEndpoint = aws.String(endpoint)
+	})
 }
 
 const region = "eu-pluto-1"
@@ -2,10 +2,12 @@ package db
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"strconv"
-	"strings"
 	"time"
 
+	"github.com/a-h/cwexport/processor"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	cw "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
@@ -21,9 +23,18 @@ func WithClient(client *dynamodb.Client) func(*MetricStore) {
 	}
 }
 
+// WithHistoryTTL sets how long run history is kept before DynamoDB deletes it. Defaults to 30 days.
+func WithHistoryTTL(ttl time.Duration) func(*MetricStore) {
+	return func(ms *MetricStore) {
+		ms.historyTTL = ttl
+	}
+}
+
 func NewMetricStore(tableName, region string, options ...OptionsFunc) (s *MetricStore, err error) {
 	s = &MetricStore{
-		tableName: tableName,
+		tableName:  tableName,
+		historyTTL: 30 * 24 * time.Hour,
+		versions:   &processor.CheckpointVersions{},
 	}
 	for _, o := range options {
 		o(s)
@@ -38,42 +49,96 @@ func NewMetricStore(tableName, region string, options ...OptionsFunc) (s *Metric
 	return
 }
 
+// NewMetricStoreFromConfig creates a store that uses a client created from AWS config, e.g. to use
+// a profile other than the default. The optFns can be used to override the client options, e.g. to
+// set an endpoint.
+func NewMetricStoreFromConfig(cfg aws.Config, tableName string, optFns ...func(*dynamodb.Options)) (s *MetricStore, err error) {
+	return NewMetricStore(tableName, cfg.Region, WithClient(dynamodb.NewFromConfig(cfg, optFns...)))
+}
+
 type MetricStore struct {
-	db        *dynamodb.Client
-	tableName string
+	db         *dynamodb.Client
+	tableName  string
+	historyTTL time.Duration
+	// versions are the checkpoint versions read by Get.
+	versions *processor.CheckpointVersions
 }
 
 func getPartitionKey(m *cw.MetricStat) string {
-	var sb strings.Builder
-	sb.WriteString(*m.Metric.Namespace)
-	sb.WriteRune('/')
-	for _, d := range m.Metric.Dimensions {
-		sb.WriteString(*d.Name)
-		sb.WriteRune('/')
-		sb.WriteString(*d.Value)
-		sb.WriteRune('/')
-	}
-	sb.WriteString(*m.Metric.MetricName)
-	sb.WriteRune('/')
-	sb.WriteString(*m.Stat)
-	sb.WriteRune('/')
-	sb.WriteString(strconv.FormatInt(int64(*m.Period), 10))
-	return sb.String()
+	return processor.MetricKey(m)
 }
 
 func getSortKeyPosition() string {
 	return "position"
 }
 
-// _pk             _sk               lastStart                    name     email
-// ns/logins/sum   position          2022-04-01T13:13:35.000Z
-// ns/logins/sum   user                                           adrian   a@example.com
+func getSortKeyLease() string {
+	return "lease"
+}
 
+func getSortKeyStatus() string {
+	return "status"
+}
+
+func getSortKeyRun(started time.Time) string {
+	return "run/" + started.UTC().Format(time.RFC3339Nano)
+}
+
+// _pk             _sk                          lastStart              version   owner     expires         _ttl
+// ns/logins/sum   position                     2022-04-01T13:13:35Z   42
+// ns/logins/sum   lease                                                         3f2a...   1648818815000   1648822415
+//
+// _pk             _sk                          finished               durationMs   windowCount   sampleCount   error   _ttl
+// ns/logins/sum   run/2022-04-01T13:15:00.1Z   2022-04-01T13:15:02Z   1900         2             12                    1651410900
+//
+// _pk             _sk                          lastRun                lastSuccess            lastFailure   lastError   consecutiveFailures
+// ns/logins/sum   status                       2022-04-01T13:15:02Z   2022-04-01T13:15:02Z                             0
+
+// Get gets the metric's checkpoint, and keeps its version so that the next Put of the metric only
+// succeeds if the checkpoint hasn't been modified since.
 func (ms MetricStore) Get(ctx context.Context, m *cw.MetricStat) (lastStart time.Time, ok bool, err error) {
+	key := getPartitionKey(m)
+	cp, ok, err := ms.GetCheckpoint(ctx, key)
+	if err != nil {
+		return
+	}
+	ms.versions.Set(key, cp.Version)
+	return cp.LastStart, ok, err
+}
+
+// Checkpoint is the position of a metric's export.
+type Checkpoint = processor.Checkpoint
+
+func checkpointFromItem(item map[string]types.AttributeValue) (cp Checkpoint, ok bool, err error) {
+	if pk, isString := item["_pk"].(*types.AttributeValueMemberS); isString {
+		cp.Key = pk.Value
+	}
+	if v, isNumber := item["version"].(*types.AttributeValueMemberN); isNumber {
+		if cp.Version, err = strconv.ParseInt(v.Value, 10, 64); err != nil {
+			return
+		}
+	}
+	// Get the item.
+	lsv, ok := item["lastStart"]
+	if !ok {
+		return
+	}
+	// Check the type of the item.
+	lsvs, ok := lsv.(*types.AttributeValueMemberS)
+	if !ok {
+		return
+	}
+	// Parse the attribute value as a date.
+	cp.LastStart, err = time.Parse(time.RFC3339, lsvs.Value)
+	return
+}
+
+// GetCheckpoint gets the checkpoint of the metric with the given key.
+func (ms MetricStore) GetCheckpoint(ctx context.Context, key string) (cp Checkpoint, ok bool, err error) {
 	gio, err := ms.db.GetItem(ctx, &dynamodb.GetItemInput{
 		Key: map[string]types.AttributeValue{
 			"_pk": &types.AttributeValueMemberS{
-				Value: getPartitionKey(m),
+				Value: key,
 			},
 			"_sk": &types.AttributeValueMemberS{
 				Value: getSortKeyPosition(),
@@ -85,38 +150,361 @@ func (ms MetricStore) Get(ctx context.Context, m *cw.MetricStat) (lastStart time
 	if err != nil || gio.Item == nil {
 		return
 	}
-	// Get the item.
-	lsv, ok := gio.Item["lastStart"]
-	if !ok {
+	return checkpointFromItem(gio.Item)
+}
+
+// ListCheckpoints scans the table for the checkpoints of all metrics.
+func (ms MetricStore) ListCheckpoints(ctx context.Context) (cps []Checkpoint, err error) {
+	paginator := dynamodb.NewScanPaginator(ms.db, &dynamodb.ScanInput{
+		FilterExpression: aws.String("#sk = :position"),
+		ExpressionAttributeNames: map[string]string{
+			"#sk": "_sk",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":position": &types.AttributeValueMemberS{
+				Value: getSortKeyPosition(),
+			},
+		},
+		TableName:      &ms.tableName,
+		ConsistentRead: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		var page *dynamodb.ScanOutput
+		page, err = paginator.NextPage(ctx)
+		if err != nil {
+			return
+		}
+		for _, item := range page.Items {
+			cp, ok, err := checkpointFromItem(item)
+			if err != nil {
+				return cps, err
+			}
+			if ok {
+				cps = append(cps, cp)
+			}
+		}
+	}
+	return
+}
+
+// SetCheckpoint sets the checkpoint of the metric with the given key, even if it moves the checkpoint
+// backwards. It's used to replay or skip data. The checkpoint must have the expected version, which
+// is 0 if it doesn't exist, otherwise processor.ErrCheckpointConflict is returned, so that a
+// checkpoint moved by a processor since it was read isn't overwritten.
+func (ms MetricStore) SetCheckpoint(ctx context.Context, key string, lastStart time.Time, expectedVersion int64) (cp Checkpoint, err error) {
+	uio, err := ms.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		Key: map[string]types.AttributeValue{
+			"_pk": &types.AttributeValueMemberS{
+				Value: key,
+			},
+			"_sk": &types.AttributeValueMemberS{
+				Value: getSortKeyPosition(),
+			},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(version) OR version = :expected"),
+		UpdateExpression:    aws.String("SET lastStart = :lastStart ADD version :one"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":lastStart": &types.AttributeValueMemberS{
+				Value: lastStart.UTC().Format(time.RFC3339),
+			},
+			":expected": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(expectedVersion, 10),
+			},
+			":one": &types.AttributeValueMemberN{
+				Value: "1",
+			},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+		TableName:    &ms.tableName,
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		err = fmt.Errorf("%w: the checkpoint has been modified since version %d", processor.ErrCheckpointConflict, expectedVersion)
 		return
 	}
-	// Check the type of the item.
-	lsvs, ok := lsv.(*types.AttributeValueMemberS)
-	if !ok {
+	if err != nil {
 		return
 	}
-	// Parse the attribute value as a date.
-	lastStart, err = time.Parse(time.RFC3339, lsvs.Value)
+	cp, _, err = checkpointFromItem(uio.Attributes)
 	return
 }
 
+// DeleteCheckpoint deletes the checkpoint of the metric with the given key, so that the next export
+// starts from the configured start time.
+func (ms MetricStore) DeleteCheckpoint(ctx context.Context, key string) error {
+	_, err := ms.db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		Key: map[string]types.AttributeValue{
+			"_pk": &types.AttributeValueMemberS{
+				Value: key,
+			},
+			"_sk": &types.AttributeValueMemberS{
+				Value: getSortKeyPosition(),
+			},
+		},
+		TableName: &ms.tableName,
+	})
+	return err
+}
+
+// Put moves the metric's checkpoint forward to lastStart. If the stored checkpoint is already at or
+// beyond lastStart, because another processor has moved it, or has been modified since it was read
+// by Get, processor.ErrCheckpointConflict is returned.
 func (ms MetricStore) Put(ctx context.Context, m *cw.MetricStat, lastStart time.Time) error {
-	_, err := ms.db.PutItem(ctx, &dynamodb.PutItemInput{
+	key := getPartitionKey(m)
+	input := &dynamodb.UpdateItemInput{
+		Key: map[string]types.AttributeValue{
+			"_pk": &types.AttributeValueMemberS{
+				Value: key,
+			},
+			"_sk": &types.AttributeValueMemberS{
+				Value: getSortKeyPosition(),
+			},
+		},
+		// RFC3339 timestamps in UTC sort lexically.
+		ConditionExpression: aws.String("attribute_not_exists(lastStart) OR lastStart < :lastStart"),
+		UpdateExpression:    aws.String("SET lastStart = :lastStart ADD version :one"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":lastStart": &types.AttributeValueMemberS{
+				Value: lastStart.UTC().Format(time.RFC3339),
+			},
+			":one": &types.AttributeValueMemberN{
+				Value: "1",
+			},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+		TableName:    &ms.tableName,
+	}
+	expected, hasVersion := ms.versions.Get(key)
+	if hasVersion {
+		input.ConditionExpression = aws.String("(attribute_not_exists(version) OR version = :expected) AND (attribute_not_exists(lastStart) OR lastStart < :lastStart)")
+		input.ExpressionAttributeValues[":expected"] = &types.AttributeValueMemberN{
+			Value: strconv.FormatInt(expected, 10),
+		}
+	}
+	uio, err := ms.db.UpdateItem(ctx, input)
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		// The version is unknown until the checkpoint is read again.
+		ms.versions.Delete(key)
+		return fmt.Errorf("%w: %s is not after the stored checkpoint, or the checkpoint has been modified", processor.ErrCheckpointConflict, lastStart.UTC().Format(time.RFC3339))
+	}
+	if err != nil {
+		return err
+	}
+	// Keep the new version, so that the next window can be put without reading the checkpoint.
+	cp, _, err := checkpointFromItem(uio.Attributes)
+	if err != nil {
+		return err
+	}
+	ms.versions.Set(key, cp.Version)
+	return nil
+}
+
+// leaseTTL is how long an expired lease is kept before DynamoDB deletes it.
+const leaseTTL = time.Hour
+
+// AcquireLease takes the lease on the metric for the owner until it expires. If another owner holds
+// a lease that hasn't expired, ok is false.
+func (ms MetricStore) AcquireLease(ctx context.Context, m *cw.MetricStat, owner string, expires time.Time) (ok bool, err error) {
+	_, err = ms.db.PutItem(ctx, &dynamodb.PutItemInput{
 		Item: map[string]types.AttributeValue{
 			"_pk": &types.AttributeValueMemberS{
 				Value: getPartitionKey(m),
 			},
 			"_sk": &types.AttributeValueMemberS{
-				Value: getSortKeyPosition(),
+				Value: getSortKeyLease(),
+			},
+			"owner": &types.AttributeValueMemberS{
+				Value: owner,
+			},
+			"expires": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(expires.UnixMilli(), 10),
 			},
-			"lastStart": &types.AttributeValueMemberS{
-				Value: lastStart.Format(time.RFC3339),
+			"_ttl": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(expires.Add(leaseTTL).Unix(), 10),
+			},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(#owner) OR #owner = :owner OR #expires < :now"),
+		ExpressionAttributeNames: map[string]string{
+			"#owner":   "owner",
+			"#expires": "expires",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{
+				Value: owner,
+			},
+			":now": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(time.Now().UnixMilli(), 10),
 			},
 		},
 		TableName: &ms.tableName,
 	})
-	if err != nil {
-		return err
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ReleaseLease releases the owner's lease on the metric. If the lease has since been taken by
+// another owner, it's left in place.
+func (ms MetricStore) ReleaseLease(ctx context.Context, m *cw.MetricStat, owner string) error {
+	_, err := ms.db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		Key: map[string]types.AttributeValue{
+			"_pk": &types.AttributeValueMemberS{
+				Value: getPartitionKey(m),
+			},
+			"_sk": &types.AttributeValueMemberS{
+				Value: getSortKeyLease(),
+			},
+		},
+		ConditionExpression: aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]string{
+			"#owner": "owner",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{
+				Value: owner,
+			},
+		},
+		TableName: &ms.tableName,
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return nil
 	}
 	return err
 }
+
+// RecordRun writes a history item for the run, which expires after the history TTL, and updates
+// the metric's status.
+func (ms MetricStore) RecordRun(ctx context.Context, m *cw.MetricStat, run processor.Run) error {
+	pk := getPartitionKey(m)
+	item := map[string]types.AttributeValue{
+		"_pk": &types.AttributeValueMemberS{
+			Value: pk,
+		},
+		"_sk": &types.AttributeValueMemberS{
+			Value: getSortKeyRun(run.Started),
+		},
+		"started": &types.AttributeValueMemberS{
+			Value: run.Started.UTC().Format(time.RFC3339Nano),
+		},
+		"finished": &types.AttributeValueMemberS{
+			Value: run.Finished.UTC().Format(time.RFC3339Nano),
+		},
+		"durationMs": &types.AttributeValueMemberN{
+			Value: strconv.FormatInt(run.Duration().Milliseconds(), 10),
+		},
+		"windowCount": &types.AttributeValueMemberN{
+			Value: strconv.Itoa(run.Result.WindowCount),
+		},
+		"sampleCount": &types.AttributeValueMemberN{
+			Value: strconv.Itoa(run.Result.SampleCount),
+		},
+		"position": &types.AttributeValueMemberS{
+			Value: run.Result.Position.UTC().Format(time.RFC3339),
+		},
+		"_ttl": &types.AttributeValueMemberN{
+			Value: strconv.FormatInt(run.Started.Add(ms.historyTTL).Unix(), 10),
+		},
+	}
+	// Successful runs have no error attribute.
+	if run.Error != "" {
+		item["error"] = &types.AttributeValueMemberS{
+			Value: run.Error,
+		}
+	}
+	_, err := ms.db.PutItem(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: &ms.tableName,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put run history: %w", err)
+	}
+
+	finished := &types.AttributeValueMemberS{
+		Value: run.Finished.UTC().Format(time.RFC3339Nano),
+	}
+	update := &dynamodb.UpdateItemInput{
+		Key: map[string]types.AttributeValue{
+			"_pk": &types.AttributeValueMemberS{
+				Value: pk,
+			},
+			"_sk": &types.AttributeValueMemberS{
+				Value: getSortKeyStatus(),
+			},
+		},
+		// The last failure is kept, but its error is removed, since it no longer describes the metric.
+		UpdateExpression: aws.String("SET lastRun = :finished, lastSuccess = :finished, consecutiveFailures = :zero REMOVE lastError"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":finished": finished,
+			":zero": &types.AttributeValueMemberN{
+				Value: "0",
+			},
+		},
+		TableName: &ms.tableName,
+	}
+	if run.Error != "" {
+		update.UpdateExpression = aws.String("SET lastRun = :finished, lastFailure = :finished, lastError = :error ADD consecutiveFailures :one")
+		update.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":finished": finished,
+			":error": &types.AttributeValueMemberS{
+				Value: run.Error,
+			},
+			":one": &types.AttributeValueMemberN{
+				Value: "1",
+			},
+		}
+	}
+	_, err = ms.db.UpdateItem(ctx, update)
+	if err != nil {
+		return fmt.Errorf("failed to update status: %w", err)
+	}
+	return nil
+}
+
+// GetStatus returns the status of the metric's runs. If the metric has never been run, ok is false.
+func (ms MetricStore) GetStatus(ctx context.Context, m *cw.MetricStat) (status processor.Status, ok bool, err error) {
+	gio, err := ms.db.GetItem(ctx, &dynamodb.GetItemInput{
+		Key: map[string]types.AttributeValue{
+			"_pk": &types.AttributeValueMemberS{
+				Value: getPartitionKey(m),
+			},
+			"_sk": &types.AttributeValueMemberS{
+				Value: getSortKeyStatus(),
+			},
+		},
+		TableName:      &ms.tableName,
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || gio.Item == nil {
+		return
+	}
+	ok = true
+	if status.LastRun, err = getTime(gio.Item, "lastRun"); err != nil {
+		return
+	}
+	if status.LastSuccess, err = getTime(gio.Item, "lastSuccess"); err != nil {
+		return
+	}
+	if status.LastFailure, err = getTime(gio.Item, "lastFailure"); err != nil {
+		return
+	}
+	if v, isString := gio.Item["lastError"].(*types.AttributeValueMemberS); isString {
+		status.LastError = v.Value
+	}
+	if v, isNumber := gio.Item["consecutiveFailures"].(*types.AttributeValueMemberN); isNumber {
+		status.ConsecutiveFailures, err = strconv.Atoi(v.Value)
+	}
+	return
+}
+
+// getTime parses the attribute as an RFC3339 time, returning the zero time if it's missing.
+func getTime(item map[string]types.AttributeValue, name string) (t time.Time, err error) {
+	v, ok := item[name].(*types.AttributeValueMemberS)
+	if !ok {
+		return
+	}
+	return time.Parse(time.RFC3339Nano, v.Value)
+}
@@ -2,9 +2,12 @@ package db
 
 import (
 	"context"
+	"errors"
 	"testing"
 	"time"
 
+	"github.com/a-h/cwexport/processor"
+	"github.com/a-h/cwexport/processor/storetest"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	cw "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 )
@@ -154,3 +157,331 @@ func TestMetricStore(t *testing.T) {
 		}
 	})
 }
+
+func TestMetricStoreConformance(t *testing.T) {
+	if testing.Short() {
+		return
+	}
+	storetest.Run(t, func(t *testing.T) processor.MetricStore {
+		tableName := createLocalTable(t)
+		t.Cleanup(func() { deleteLocalTable(t, tableName) })
+		ms, err := NewMetricStore(tableName, region, WithClient(testClient))
+		if err != nil {
+			t.Fatalf("cannot create metric store: %v", err)
+		}
+		return ms
+	})
+}
+
+func TestMetricStoreConflict(t *testing.T) {
+	if testing.Short() {
+		return
+	}
+	tableName := createLocalTable(t)
+	defer deleteLocalTable(t, tableName)
+
+	ms, err := NewMetricStore(tableName, region, WithClient(testClient))
+	if err != nil {
+		t.Fatalf("cannot create metric store: %v", err)
+	}
+	ctx := context.Background()
+	m := &cw.MetricStat{
+		Metric: &cw.Metric{
+			Namespace:  aws.String("ns"),
+			MetricName: aws.String("metricA"),
+		},
+		Period: aws.Int32(1),
+		Stat:   aws.String("Sum"),
+	}
+	lastStart := time.Date(2000, time.January, 2, 0, 0, 0, 0, time.UTC)
+	if err = ms.Put(ctx, m, lastStart); err != nil {
+		t.Fatalf("unexpected error putting metric: %v", err)
+	}
+	t.Run("it cannot move a checkpoint backwards", func(t *testing.T) {
+		err := ms.Put(ctx, m, lastStart.Add(-time.Minute))
+		if !errors.Is(err, processor.ErrCheckpointConflict) {
+			t.Fatalf("expected conflict error, got %v", err)
+		}
+	})
+	t.Run("it cannot write the same checkpoint twice", func(t *testing.T) {
+		err := ms.Put(ctx, m, lastStart)
+		if !errors.Is(err, processor.ErrCheckpointConflict) {
+			t.Fatalf("expected conflict error, got %v", err)
+		}
+	})
+	t.Run("the checkpoint is unchanged after a conflict", func(t *testing.T) {
+		actualLastStart, _, err := ms.Get(ctx, m)
+		if err != nil {
+			t.Fatalf("unexpected error getting metric: %v", err)
+		}
+		if !actualLastStart.Equal(lastStart) {
+			t.Fatalf("expected last start %v, got %v", lastStart, actualLastStart)
+		}
+	})
+}
+
+func TestMetricStoreLease(t *testing.T) {
+	if testing.Short() {
+		return
+	}
+	tableName := createLocalTable(t)
+	defer deleteLocalTable(t, tableName)
+
+	ms, err := NewMetricStore(tableName, region, WithClient(testClient))
+	if err != nil {
+		t.Fatalf("cannot create metric store: %v", err)
+	}
+	ctx := context.Background()
+	m := &cw.MetricStat{
+		Metric: &cw.Metric{
+			Namespace:  aws.String("ns"),
+			MetricName: aws.String("metricA"),
+		},
+		Period: aws.Int32(1),
+		Stat:   aws.String("Sum"),
+	}
+	t.Run("it can acquire a lease that isn't held", func(t *testing.T) {
+		ok, err := ms.AcquireLease(ctx, m, "a", time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatalf("unexpected error acquiring lease: %v", err)
+		}
+		if !ok {
+			t.Fatal("expected ok=true, got ok=false")
+		}
+	})
+	t.Run("it cannot acquire a lease held by another owner", func(t *testing.T) {
+		ok, err := ms.AcquireLease(ctx, m, "b", time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatalf("unexpected error acquiring lease: %v", err)
+		}
+		if ok {
+			t.Fatal("expected ok=false, got ok=true")
+		}
+	})
+	t.Run("releasing another owner's lease leaves it in place", func(t *testing.T) {
+		err := ms.ReleaseLease(ctx, m, "b")
+		if err != nil {
+			t.Fatalf("unexpected error releasing lease: %v", err)
+		}
+		ok, err := ms.AcquireLease(ctx, m, "b", time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatalf("unexpected error acquiring lease: %v", err)
+		}
+		if ok {
+			t.Fatal("expected ok=false, got ok=true")
+		}
+	})
+	t.Run("it can acquire a lease once it's released", func(t *testing.T) {
+		err := ms.ReleaseLease(ctx, m, "a")
+		if err != nil {
+			t.Fatalf("unexpected error releasing lease: %v", err)
+		}
+		ok, err := ms.AcquireLease(ctx, m, "b", time.Now().Add(-time.Second))
+		if err != nil {
+			t.Fatalf("unexpected error acquiring lease: %v", err)
+		}
+		if !ok {
+			t.Fatal("expected ok=true, got ok=false")
+		}
+	})
+	t.Run("it can acquire an expired lease", func(t *testing.T) {
+		ok, err := ms.AcquireLease(ctx, m, "a", time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatalf("unexpected error acquiring lease: %v", err)
+		}
+		if !ok {
+			t.Fatal("expected ok=true, got ok=false")
+		}
+	})
+}
+
+func TestMetricStoreRunHistory(t *testing.T) {
+	if testing.Short() {
+		return
+	}
+	tableName := createLocalTable(t)
+	defer deleteLocalTable(t, tableName)
+
+	ms, err := NewMetricStore(tableName, region, WithClient(testClient))
+	if err != nil {
+		t.Fatalf("cannot create metric store: %v", err)
+	}
+	ctx := context.Background()
+	m := &cw.MetricStat{
+		Metric: &cw.Metric{
+			Namespace:  aws.String("ns"),
+			MetricName: aws.String("metricA"),
+		},
+		Period: aws.Int32(1),
+		Stat:   aws.String("Sum"),
+	}
+	t.Run("a metric that has never run has no status", func(t *testing.T) {
+		_, ok, err := ms.GetStatus(ctx, m)
+		if err != nil {
+			t.Fatalf("unexpected error getting status: %v", err)
+		}
+		if ok {
+			t.Fatal("expected ok=false, got ok=true")
+		}
+	})
+	started := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	failures := []processor.Run{
+		{Started: started, Finished: started.Add(time.Second), Error: "first"},
+		{Started: started.Add(time.Minute), Finished: started.Add(time.Minute + time.Second), Error: "second"},
+	}
+	t.Run("failed runs are counted", func(t *testing.T) {
+		for _, run := range failures {
+			if err := ms.RecordRun(ctx, m, run); err != nil {
+				t.Fatalf("unexpected error recording run: %v", err)
+			}
+		}
+		status, ok, err := ms.GetStatus(ctx, m)
+		if err != nil {
+			t.Fatalf("unexpected error getting status: %v", err)
+		}
+		if !ok {
+			t.Fatal("expected ok=true, got ok=false")
+		}
+		if status.ConsecutiveFailures != 2 {
+			t.Errorf("expected 2 consecutive failures, got %d", status.ConsecutiveFailures)
+		}
+		if status.LastError != "second" {
+			t.Errorf("expected the last error to be recorded, got %q", status.LastError)
+		}
+		if !status.LastFailure.Equal(failures[1].Finished) {
+			t.Errorf("expected last failure %v, got %v", failures[1].Finished, status.LastFailure)
+		}
+		if !status.LastSuccess.IsZero() {
+			t.Errorf("expected no last success, got %v", status.LastSuccess)
+		}
+	})
+	success := processor.Run{
+		Started:  started.Add(2 * time.Minute),
+		Finished: started.Add(2*time.Minute + time.Second),
+	}
+	t.Run("a successful run resets the failure count", func(t *testing.T) {
+		if err := ms.RecordRun(ctx, m, success); err != nil {
+			t.Fatalf("unexpected error recording run: %v", err)
+		}
+		status, _, err := ms.GetStatus(ctx, m)
+		if err != nil {
+			t.Fatalf("unexpected error getting status: %v", err)
+		}
+		if status.ConsecutiveFailures != 0 {
+			t.Errorf("expected 0 consecutive failures, got %d", status.ConsecutiveFailures)
+		}
+		if !status.LastSuccess.Equal(success.Finished) || !status.LastRun.Equal(success.Finished) {
+			t.Errorf("expected last success and last run to be %v, got %v", success.Finished, status)
+		}
+		if !status.LastFailure.Equal(failures[1].Finished) {
+			t.Errorf("expected the last failure to be kept, got %v", status.LastFailure)
+		}
+		if status.LastError != "" {
+			t.Errorf("expected the last error to be removed, got %q", status.LastError)
+		}
+	})
+}
+
+func TestMetricStoreCheckpoints(t *testing.T) {
+	if testing.Short() {
+		return
+	}
+	tableName := createLocalTable(t)
+	defer deleteLocalTable(t, tableName)
+
+	ms, err := NewMetricStore(tableName, region, WithClient(testClient))
+	if err != nil {
+		t.Fatalf("cannot create metric store: %v", err)
+	}
+	ctx := context.Background()
+	m := &cw.MetricStat{
+		Metric: &cw.Metric{
+			Namespace:  aws.String("ns"),
+			MetricName: aws.String("metricA"),
+		},
+		Period: aws.Int32(1),
+		Stat:   aws.String("Sum"),
+	}
+	key := processor.MetricKey(m)
+	lastStart := time.Date(2000, time.January, 2, 0, 0, 0, 0, time.UTC)
+	if err = ms.Put(ctx, m, lastStart); err != nil {
+		t.Fatalf("unexpected error putting metric: %v", err)
+	}
+	// Other items for the metric shouldn't be listed.
+	if err = ms.RecordRun(ctx, m, processor.Run{Started: lastStart, Finished: lastStart}); err != nil {
+		t.Fatalf("unexpected error recording run: %v", err)
+	}
+	t.Run("it can list checkpoints", func(t *testing.T) {
+		cps, err := ms.ListCheckpoints(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error listing checkpoints: %v", err)
+		}
+		if len(cps) != 1 {
+			t.Fatalf("expected 1 checkpoint, got %d", len(cps))
+		}
+		if cps[0].Key != key || !cps[0].LastStart.Equal(lastStart) || cps[0].Version != 1 {
+			t.Errorf("unexpected checkpoint %v", cps[0])
+		}
+	})
+	t.Run("it can't set a checkpoint that has been modified", func(t *testing.T) {
+		_, err := ms.SetCheckpoint(ctx, key, lastStart.Add(-time.Hour), 0)
+		if !errors.Is(err, processor.ErrCheckpointConflict) {
+			t.Fatalf("expected a checkpoint conflict, got %v", err)
+		}
+	})
+	t.Run("it can set a checkpoint backwards", func(t *testing.T) {
+		// Read the checkpoint, as the processor does before it exports a window.
+		if _, _, err := ms.Get(ctx, m); err != nil {
+			t.Fatalf("unexpected error getting metric: %v", err)
+		}
+		cp, err := ms.SetCheckpoint(ctx, key, lastStart.Add(-time.Hour), 1)
+		if err != nil {
+			t.Fatalf("unexpected error setting checkpoint: %v", err)
+		}
+		if !cp.LastStart.Equal(lastStart.Add(-time.Hour)) || cp.Version != 2 {
+			t.Errorf("unexpected checkpoint %v", cp)
+		}
+		actualLastStart, _, err := ms.Get(ctx, m)
+		if err != nil {
+			t.Fatalf("unexpected error getting metric: %v", err)
+		}
+		if !actualLastStart.Equal(lastStart.Add(-time.Hour)) {
+			t.Errorf("expected the checkpoint to be rewound, got %v", actualLastStart)
+		}
+	})
+	t.Run("a put fails if the checkpoint was set since it was read", func(t *testing.T) {
+		other, err := NewMetricStore(tableName, region, WithClient(testClient))
+		if err != nil {
+			t.Fatalf("cannot create metric store: %v", err)
+		}
+		if _, _, err = other.Get(ctx, m); err != nil {
+			t.Fatalf("unexpected error getting metric: %v", err)
+		}
+		if _, err = ms.SetCheckpoint(ctx, key, lastStart.Add(-2*time.Hour), 2); err != nil {
+			t.Fatalf("unexpected error setting checkpoint: %v", err)
+		}
+		err = other.Put(ctx, m, lastStart.Add(time.Hour))
+		if !errors.Is(err, processor.ErrCheckpointConflict) {
+			t.Fatalf("expected a checkpoint conflict, got %v", err)
+		}
+		actualLastStart, _, err := ms.Get(ctx, m)
+		if err != nil {
+			t.Fatalf("unexpected error getting metric: %v", err)
+		}
+		if !actualLastStart.Equal(lastStart.Add(-2 * time.Hour)) {
+			t.Errorf("expected the rewound checkpoint to be kept, got %v", actualLastStart)
+		}
+	})
+	t.Run("it can delete a checkpoint", func(t *testing.T) {
+		if err := ms.DeleteCheckpoint(ctx, key); err != nil {
+			t.Fatalf("unexpected error deleting checkpoint: %v", err)
+		}
+		_, ok, err := ms.GetCheckpoint(ctx, key)
+		if err != nil {
+			t.Fatalf("unexpected error getting checkpoint: %v", err)
+		}
+		if ok {
+			t.Fatal("expected ok=false, got ok=true")
+		}
+	})
+}
@@ -6,24 +6,50 @@ import (
 
 	"github.com/a-h/cwexport/cdk"
 	"github.com/aws/aws-cdk-go/awscdk/v2"
-	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 )
 
 type Arguments struct {
-	Stats            *[]types.MetricStat
+	Metrics          []cdk.Metric
+	Settings         cdk.FunctionSettings
 	FirehoseRoleName string
 	BucketName       string
+	CheckpointStore  cdk.CheckpointStore
+	Consolidated     bool
+	Prefix           string
+	Athena           *cdk.AthenaSettings
+	Format           cdk.Format
+	Storage          cdk.StorageSettings
+	Alarms           cdk.AlarmSettings
+	// Profile is the AWS shared config profile that the CDK CLI deploys with, if it isn't the default.
+	Profile string
+	// Region is the AWS region to deploy to, if it isn't the default.
+	Region string
 }
 
 func Run(args Arguments) error {
 	app := awscdk.NewApp(nil)
 	cdk.NewCDKStack(app, "cwexport", &cdk.CDKStackProps{
-		Stats:            args.Stats,
+		Metrics:          args.Metrics,
+		Settings:         args.Settings,
 		FirehoseRoleName: args.FirehoseRoleName,
 		BucketName:       args.BucketName,
+		CheckpointStore:  args.CheckpointStore,
+		Consolidated:     args.Consolidated,
+		Prefix:           args.Prefix,
+		Athena:           args.Athena,
+		Format:           args.Format,
+		Storage:          args.Storage,
+		Alarms:           args.Alarms,
 	})
 	cxa := app.Synth(nil)
-	com := exec.Command("cdk", "deploy", "--app="+*cxa.Directory(), "--require-approval=never")
+	cdkArgs := []string{"deploy", "--app=" + *cxa.Directory(), "--require-approval=never"}
+	if args.Profile != "" {
+		cdkArgs = append(cdkArgs, "--profile="+args.Profile)
+	}
+	com := exec.Command("cdk", cdkArgs...)
+	if args.Region != "" {
+		com.Env = append(os.Environ(), "AWS_REGION="+args.Region, "AWS_DEFAULT_REGION="+args.Region, "CDK_DEFAULT_REGION="+args.Region)
+	}
 	com.Stdin = os.Stdin
 	com.Stdout = os.Stdout
 	com.Stderr = os.Stderr
@@ -3,6 +3,7 @@ package firehose
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 
 	"github.com/a-h/cwexport/processor"
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -15,10 +16,12 @@ type Firehose struct {
 	FirehoseClient     *awsfirehose.Client
 }
 
-func New(config aws.Config, deliveryStreamName string) (fh Firehose, err error) {
+// New creates a Firehose that puts records into the delivery stream. The optFns can be used to
+// override the client options, e.g. to set an endpoint.
+func New(config aws.Config, deliveryStreamName string, optFns ...func(*awsfirehose.Options)) (fh Firehose, err error) {
 	return Firehose{
 		DeliveryStreamName: deliveryStreamName,
-		FirehoseClient:     awsfirehose.NewFromConfig(config),
+		FirehoseClient:     awsfirehose.NewFromConfig(config, optFns...),
 	}, nil
 }
 
@@ -32,14 +35,57 @@ func (f Firehose) Put(ctx context.Context, metrics []processor.MetricSample) err
 		if err != nil {
 			return err
 		}
+		// Delimit the records, so that each is a line of the delivered file.
 		records[i] = types.Record{
-			Data: data,
+			Data: append(data, '\n'),
 		}
 	}
 
-	_, err := f.FirehoseClient.PutRecordBatch(ctx, &awsfirehose.PutRecordBatchInput{
+	out, err := f.FirehoseClient.PutRecordBatch(ctx, &awsfirehose.PutRecordBatchInput{
 		DeliveryStreamName: &f.DeliveryStreamName,
 		Records:            records,
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	if aws.ToInt32(out.FailedPutCount) == 0 {
+		return nil
+	}
+	// The responses are in the same order as the records, and have an error code if the record
+	// wasn't put.
+	perr := &processor.PartialPutError{}
+	for i, r := range out.RequestResponses {
+		if r.ErrorCode == nil || i >= len(metrics) {
+			continue
+		}
+		if perr.Err == nil {
+			perr.Err = RecordError{Code: aws.ToString(r.ErrorCode), Message: aws.ToString(r.ErrorMessage)}
+		}
+		perr.Failed = append(perr.Failed, metrics[i])
+	}
+	if perr.Err == nil {
+		return fmt.Errorf("firehose failed to put %d records without a per-record error", aws.ToInt32(out.FailedPutCount))
+	}
+	return perr
+}
+
+// RecordError is the error of a record that Firehose failed to put. Firehose only fails individual
+// records when the delivery stream is throttled or has an internal failure, so they're retryable.
+type RecordError struct {
+	Code    string
+	Message string
+}
+
+func (e RecordError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// ErrorCode returns the error code of the record, e.g. ServiceUnavailableException.
+func (e RecordError) ErrorCode() string {
+	return e.Code
+}
+
+// RetryableError marks the error as retryable for the SDK's retry classification.
+func (e RecordError) RetryableError() bool {
+	return true
 }
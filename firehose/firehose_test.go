@@ -0,0 +1,92 @@
+package firehose
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/a-h/cwexport/cw"
+	"github.com/a-h/cwexport/processor"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+func newTestFirehose(url string) Firehose {
+	fh, _ := New(aws.Config{
+		Region:       "eu-pluto-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("fake", "accessKeyId", "secretKeyId"),
+		Retryer:      func() aws.Retryer { return aws.NopRetryer{} },
+		BaseEndpoint: aws.String(url),
+	}, "stream")
+	return fh
+}
+
+func TestPut(t *testing.T) {
+	samples := []processor.MetricSample{
+		{Sample: cw.Sample{Value: 1}},
+		{Sample: cw.Sample{Value: 2}},
+		{Sample: cw.Sample{Value: 3}},
+	}
+	tests := []struct {
+		name           string
+		response       string
+		expectedFailed []float64
+	}{
+		{
+			name:     "no errors are returned when every record is put",
+			response: `{"FailedPutCount":0,"RequestResponses":[{"RecordId":"a"},{"RecordId":"b"},{"RecordId":"c"}]}`,
+		},
+		{
+			name:           "records that fail are returned in a partial put error",
+			response:       `{"FailedPutCount":2,"RequestResponses":[{"ErrorCode":"ServiceUnavailableException","ErrorMessage":"Slow down."},{"RecordId":"b"},{"ErrorCode":"InternalFailure","ErrorMessage":"Internal failure."}]}`,
+			expectedFailed: []float64{1, 3},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if target := r.Header.Get("X-Amz-Target"); target != "Firehose_20150804.PutRecordBatch" {
+					t.Errorf("expected PutRecordBatch request, got %q", target)
+				}
+				var req struct {
+					DeliveryStreamName string
+					Records            []json.RawMessage
+				}
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					t.Errorf("failed to decode request: %v", err)
+				}
+				if req.DeliveryStreamName != "stream" || len(req.Records) != len(samples) {
+					t.Errorf("expected %d records for the stream, got %d for %q", len(samples), len(req.Records), req.DeliveryStreamName)
+				}
+				w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+				w.Write([]byte(test.response))
+			}))
+			defer server.Close()
+
+			err := newTestFirehose(server.URL).Put(context.Background(), samples)
+			if test.expectedFailed == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			var partial *processor.PartialPutError
+			if !errors.As(err, &partial) {
+				t.Fatalf("expected a partial put error, got %v", err)
+			}
+			var failed []float64
+			for _, ms := range partial.Failed {
+				failed = append(failed, ms.Sample.Value)
+			}
+			if len(failed) != len(test.expectedFailed) || failed[0] != test.expectedFailed[0] || failed[1] != test.expectedFailed[1] {
+				t.Errorf("expected the failed samples %v, got %v", test.expectedFailed, failed)
+			}
+			if !processor.IsRetryable(err) {
+				t.Errorf("expected failed records to be retryable, got %v", err)
+			}
+		})
+	}
+}
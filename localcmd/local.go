@@ -9,6 +9,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/a-h/cwexport/awsconfig"
 	"github.com/a-h/cwexport/cw"
 	"github.com/a-h/cwexport/processor"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
@@ -26,15 +27,42 @@ type Args struct {
 	Start      time.Time
 	Format     Format
 	MetricStat *types.MetricStat
-	writer     io.Writer
+	// Follow keeps the command running after it has caught up, exporting each period as it closes.
+	Follow bool
+	// Delay is how long to wait after a period closes before exporting it, to allow
+	// CloudWatch to publish late samples. It only applies when following, so that a single run
+	// exports every closed period.
+	Delay time.Duration
+	// Store keeps checkpoints, so that an export resumes from where it stopped. If nil, checkpoints
+	// are kept in memory. If the store is also a processor.Leaser, only one export of the metric
+	// can run at a time.
+	Store processor.MetricStore
+	// AWS configures the profile, region and endpoints of the AWS clients.
+	AWS awsconfig.Settings
+	// writer receives the exported samples, and defaults to stdout.
+	writer io.Writer
+	// summaryWriter receives a summary of each run of the processor, and defaults to stderr.
+	summaryWriter io.Writer
+	getter        processor.MetricGetter
 }
 
-type nopMetricStore struct{}
+// leaseDuration is how long each run of the processor holds the lease on the metric.
+const leaseDuration = 5 * time.Minute
 
-func (nopMetricStore) Get(ctx context.Context, m *types.MetricStat) (lastStart time.Time, ok bool, err error) {
-	return
+// memoryMetricStore keeps the last position in memory, so that follow mode can carry on from
+// where the previous run of the processor stopped.
+type memoryMetricStore struct {
+	lastStart time.Time
+	ok        bool
+}
+
+func (s *memoryMetricStore) Get(ctx context.Context, m *types.MetricStat) (lastStart time.Time, ok bool, err error) {
+	return s.lastStart, s.ok, nil
 }
-func (nopMetricStore) Put(ctx context.Context, m *types.MetricStat, lastStart time.Time) (err error) {
+
+func (s *memoryMetricStore) Put(ctx context.Context, m *types.MetricStat, lastStart time.Time) (err error) {
+	s.lastStart = lastStart
+	s.ok = true
 	return
 }
 
@@ -84,11 +112,21 @@ func (p jsonPutter) Put(ctx context.Context, ms []processor.MetricSample) error
 	return nil
 }
 
-func Run(args Args) (err error) {
+func Run(ctx context.Context, args Args) (err error) {
 	logger := zap.NewNop()
 	if args.writer == nil {
 		args.writer = os.Stdout
 	}
+	if args.summaryWriter == nil {
+		args.summaryWriter = os.Stderr
+	}
+	if args.getter == nil {
+		cfg, err := args.AWS.Load(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to load SDK config: %w", err)
+		}
+		args.getter = cw.NewFromConfig(cfg, args.AWS.CloudWatchOptions)
+	}
 	var putter processor.MetricPutter
 	switch args.Format {
 	case FormatCSV:
@@ -100,18 +138,51 @@ func Run(args Args) (err error) {
 		return
 	}
 
-	p, err := processor.New(logger, nopMetricStore{}, putter, cw.Cloudwatch{})
+	if args.Store == nil {
+		args.Store = &memoryMetricStore{}
+	}
+	var options []processor.OptionsFunc
+	if args.Follow {
+		options = append(options, processor.WithPublicationDelay(args.Delay))
+	}
+	if leaser, ok := args.Store.(processor.Leaser); ok {
+		options = append(options, processor.WithLease(leaser, leaseDuration))
+	}
+	p, err := processor.New(logger, args.Store, putter, args.getter, options...)
 	if err != nil {
 		logger.Error("Failed to create new processor", zap.Error(err))
 		return
 	}
 
-	err = p.Process(context.Background(), args.Start, args.MetricStat)
-	if err != nil {
-		logger.Error("An error occured during processing", zap.Error(err))
-		return
+	for {
+		var res processor.Result
+		res, err = p.Process(ctx, args.Start, args.MetricStat)
+		if !args.Follow || res.WindowCount > 0 || len(res.Errors) > 0 {
+			fmt.Fprintln(args.summaryWriter, res)
+		}
+		if ctx.Err() != nil {
+			// Interrupted, everything that was exported has already been written.
+			return nil
+		}
+		if err != nil {
+			logger.Error("An error occured during processing", zap.Error(err))
+			return
+		}
+		if !args.Follow {
+			return nil
+		}
+		// Wait until the next period has closed and CloudWatch has had time to publish it.
+		wait := time.Until(res.Position.Add(processor.Interval).Add(args.Delay))
+		if res.Skipped {
+			// Another export holds the lease, check again later in case it stops.
+			wait = processor.Interval
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
 	}
-	return nil
 }
 
 func IsValidFormat(f Format) bool {
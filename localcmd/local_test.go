@@ -2,12 +2,14 @@ package localcmd
 
 import (
 	"context"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/a-h/cwexport/cw"
 	"github.com/a-h/cwexport/processor"
+	"github.com/a-h/cwexport/sqlstore"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 )
@@ -78,3 +80,136 @@ func TestOutput(t *testing.T) {
 		})
 	}
 }
+
+type mockGetter struct {
+	calls    int
+	onSample func(calls int)
+}
+
+func (g *mockGetter) GetSamples(ctx context.Context, metric *types.MetricStat, start time.Time, end time.Time) (samples []cw.Sample, err error) {
+	g.calls++
+	g.onSample(g.calls)
+	return []cw.Sample{{Time: start, Value: 1}}, nil
+}
+
+func TestFollow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	getter := &mockGetter{
+		onSample: func(calls int) {
+			if calls == 3 {
+				// Stop waiting for the next period once the command has caught up.
+				go func() {
+					time.Sleep(50 * time.Millisecond)
+					cancel()
+				}()
+			}
+		},
+	}
+	var w, summary strings.Builder
+	args := Args{
+		Start:  time.Now().Add(-3 * processor.Interval),
+		Format: FormatCSV,
+		MetricStat: &types.MetricStat{
+			Metric: &types.Metric{
+				MetricName: aws.String("metricsname"),
+				Namespace:  aws.String("namespace"),
+			},
+			Stat: aws.String("Sum"),
+		},
+		Follow:        true,
+		writer:        &w,
+		summaryWriter: &summary,
+		getter:        getter,
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- Run(ctx, args)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for follow mode to stop")
+	}
+	if getter.calls != 3 {
+		t.Errorf("expected 3 periods to be exported before waiting, got %d", getter.calls)
+	}
+	if lines := strings.Count(w.String(), "\n"); lines != 3 {
+		t.Errorf("expected 3 lines of output, got %d", lines)
+	}
+	if !strings.HasPrefix(summary.String(), "exported 3 windows") {
+		t.Errorf("expected a summary of the run, got %q", summary.String())
+	}
+}
+
+func TestResumeFromStore(t *testing.T) {
+	store, err := sqlstore.Open(context.Background(), "sqlite://"+filepath.Join(t.TempDir(), "cwexport.db"))
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+	getter := &mockGetter{onSample: func(calls int) {}}
+	metricStat := &types.MetricStat{
+		Metric: &types.Metric{
+			MetricName: aws.String("metricsname"),
+			Namespace:  aws.String("namespace"),
+		},
+		Period: aws.Int32(60),
+		Stat:   aws.String("Sum"),
+	}
+	var w, summary strings.Builder
+	args := Args{
+		Start:         time.Now().Add(-3 * processor.Interval),
+		Format:        FormatCSV,
+		MetricStat:    metricStat,
+		Store:         store,
+		writer:        &w,
+		summaryWriter: &summary,
+		getter:        getter,
+	}
+	if err = Run(context.Background(), args); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if getter.calls != 3 {
+		t.Fatalf("expected 3 periods to be exported, got %d", getter.calls)
+	}
+
+	// The second run should carry on from the checkpoint, instead of the start time.
+	args.Start = time.Now().Add(-10 * processor.Interval)
+	if err = Run(context.Background(), args); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if getter.calls != 3 {
+		t.Errorf("expected no more periods to be exported, got %d", getter.calls-3)
+	}
+}
+
+func TestDelayOnlyAppliesWhenFollowing(t *testing.T) {
+	getter := &mockGetter{onSample: func(calls int) {}}
+	var w, summary strings.Builder
+	args := Args{
+		Start:  time.Now().Add(-3 * processor.Interval),
+		Format: FormatCSV,
+		MetricStat: &types.MetricStat{
+			Metric: &types.Metric{
+				MetricName: aws.String("metricsname"),
+				Namespace:  aws.String("namespace"),
+			},
+			Stat: aws.String("Sum"),
+		},
+		Delay:         2 * processor.Interval,
+		writer:        &w,
+		summaryWriter: &summary,
+		getter:        getter,
+	}
+	if err := Run(context.Background(), args); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if getter.calls != 3 {
+		t.Errorf("expected every closed period to be exported without -follow, got %d", getter.calls)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/a-h/cwexport/processor"
+)
+
+func TestMetricKeyMatchesConfig(t *testing.T) {
+	conf := configuration{
+		Metric: []metric{
+			{
+				Namespace:  "ns",
+				MetricName: "logins",
+				Stat:       "Sum",
+				Period:     60,
+				Dimensions: map[string]string{"A": "y", "B": "x"},
+			},
+		},
+	}
+	expected := processor.MetricKey(&(*conf.ToMetricStats())[0])
+	for _, flags := range [][]string{{"B/x", "A/y"}, {"A/y", "B/x"}} {
+		dims, messages := parseDimensions(flags)
+		if len(messages) > 0 {
+			t.Fatalf("unexpected messages: %v", messages)
+		}
+		if actual := metricKey("ns", "logins", "Sum", 60, dims); actual != expected {
+			t.Errorf("expected the key of %v to be %q, got %q", flags, expected, actual)
+		}
+	}
+}
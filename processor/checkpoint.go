@@ -0,0 +1,71 @@
+package processor
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Checkpoint is the position of a metric's export.
+type Checkpoint struct {
+	// Key is the canonical key of the metric, see MetricKey.
+	Key       string    `json:"key"`
+	LastStart time.Time `json:"lastStart"`
+	// Version is incremented each time the checkpoint is written.
+	Version int64 `json:"version"`
+}
+
+// CheckpointEditor lists and edits the checkpoints of a MetricStore, e.g. to replay data.
+type CheckpointEditor interface {
+	ListCheckpoints(ctx context.Context) (cps []Checkpoint, err error)
+	GetCheckpoint(ctx context.Context, key string) (cp Checkpoint, ok bool, err error)
+	// SetCheckpoint sets the checkpoint, even if it moves the checkpoint backwards. The checkpoint
+	// must have the expected version, which is 0 if it doesn't exist, otherwise
+	// ErrCheckpointConflict is returned.
+	SetCheckpoint(ctx context.Context, key string, lastStart time.Time, expectedVersion int64) (cp Checkpoint, err error)
+	DeleteCheckpoint(ctx context.Context, key string) (err error)
+}
+
+// CheckpointVersions are the checkpoint versions that a MetricStore has read, keyed by metric. The
+// store's Put only moves a checkpoint if it still has the version that was read, so that a
+// checkpoint that has been set by another writer since, e.g. rewound by the checkpoint command,
+// isn't overwritten. A nil CheckpointVersions keeps nothing.
+type CheckpointVersions struct {
+	mu sync.Mutex
+	m  map[string]int64
+}
+
+// Get returns the version of the metric's checkpoint that was last read or written.
+func (v *CheckpointVersions) Get(key string) (version int64, ok bool) {
+	if v == nil {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	version, ok = v.m[key]
+	return
+}
+
+// Set keeps the version of the metric's checkpoint.
+func (v *CheckpointVersions) Set(key string, version int64) {
+	if v == nil {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.m == nil {
+		v.m = map[string]int64{}
+	}
+	v.m[key] = version
+}
+
+// Delete forgets the version of the metric's checkpoint, e.g. after a conflict, until it's read
+// again.
+func (v *CheckpointVersions) Delete(key string) {
+	if v == nil {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.m, key)
+}
@@ -0,0 +1,117 @@
+package processor
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The processor's own metrics, written in CloudWatch Embedded Metric Format by WithMetricsWriter.
+const (
+	// MetricsNamespace is the CloudWatch namespace of the processor's metrics.
+	MetricsNamespace = "cwexport"
+	// MetricKeyDimension is the dimension that identifies the exported metric, using MetricKey.
+	MetricKeyDimension = "MetricKey"
+	// SamplesExportedMetric is the number of samples sent to the putter.
+	SamplesExportedMetric = "SamplesExported"
+	// WindowsProcessedMetric is the number of windows exported.
+	WindowsProcessedMetric = "WindowsProcessed"
+	// CheckpointLagMetric is how far the checkpoint is behind the time that processing finished,
+	// in seconds. It isn't written if the checkpoint couldn't be read.
+	CheckpointLagMetric = "CheckpointLag"
+	// APIErrorsMetric is the number of failed calls to the store, leaser, getter and putter,
+	// including calls that were retried.
+	APIErrorsMetric = "APIErrors"
+)
+
+// WithMetricsWriter writes a line of CloudWatch Embedded Metric Format to w at the end of each call
+// to Process, so that the processor's metrics are extracted from its logs. Each line is written
+// with a single call to Write, and processors created with the same option don't interleave lines.
+func WithMetricsWriter(w io.Writer) OptionsFunc {
+	mw := &metricsWriter{w: w}
+	return func(p *Processor) {
+		p.metrics = mw
+	}
+}
+
+// metricsWriter serialises the lines written by concurrent calls to Process.
+type metricsWriter struct {
+	m sync.Mutex
+	w io.Writer
+}
+
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+type emfDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+// runMetrics are the metrics of a call to Process.
+type runMetrics struct {
+	key       string
+	samples   int
+	windows   int
+	apiErrors int
+	// lag is nil if the checkpoint couldn't be read.
+	lag *time.Duration
+}
+
+// emfLine returns the metrics as a line of Embedded Metric Format.
+func (rm runMetrics) emfLine(now time.Time) ([]byte, error) {
+	metrics := []emfMetric{
+		{Name: SamplesExportedMetric, Unit: "Count"},
+		{Name: WindowsProcessedMetric, Unit: "Count"},
+		{Name: APIErrorsMetric, Unit: "Count"},
+	}
+	doc := map[string]interface{}{
+		MetricKeyDimension:     rm.key,
+		SamplesExportedMetric:  rm.samples,
+		WindowsProcessedMetric: rm.windows,
+		APIErrorsMetric:        rm.apiErrors,
+	}
+	if rm.lag != nil {
+		metrics = append(metrics, emfMetric{Name: CheckpointLagMetric, Unit: "Seconds"})
+		doc[CheckpointLagMetric] = rm.lag.Seconds()
+	}
+	doc["_aws"] = emfMetadata{
+		Timestamp: now.UnixNano() / int64(time.Millisecond),
+		CloudWatchMetrics: []emfDirective{{
+			Namespace:  MetricsNamespace,
+			Dimensions: [][]string{{MetricKeyDimension}},
+			Metrics:    metrics,
+		}},
+	}
+	line, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// write writes the metrics, logging rather than returning any error, since the metrics are only
+// informational.
+func (mw *metricsWriter) write(logger *zap.Logger, rm runMetrics) {
+	line, err := rm.emfLine(time.Now())
+	if err != nil {
+		logger.Warn("Failed to marshal metrics", zap.Error(err))
+		return
+	}
+	mw.m.Lock()
+	defer mw.m.Unlock()
+	if _, err = mw.w.Write(line); err != nil {
+		logger.Warn("Failed to write metrics", zap.Error(err))
+	}
+}
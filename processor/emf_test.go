@@ -0,0 +1,109 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/a-h/cwexport/cw"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"go.uber.org/zap"
+)
+
+func TestProcessMetrics(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	metric := &types.MetricStat{
+		Metric: &types.Metric{
+			Namespace:  aws.String("AWS/Lambda"),
+			MetricName: aws.String("Invocations"),
+		},
+		Stat:   aws.String("Sum"),
+		Period: aws.Int32(60),
+	}
+	startTime := time.Now().Add(-2 * Interval).Truncate(Interval)
+	rp := RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Millisecond,
+		MaxDelay:    time.Millisecond,
+		Retryable:   IsRetryable,
+	}
+	var attempts int
+	metricPutter := func(ctx context.Context, ms []MetricSample) error {
+		attempts++
+		if attempts == 1 {
+			return errThrottled
+		}
+		return nil
+	}
+	getter := &mockCloudwatch{
+		samples: []cw.Sample{{Value: 1}, {Value: 2}},
+	}
+	var buf bytes.Buffer
+	testProcessor, _ := New(logger, &mockMetricStore{}, metricPutter, getter, WithRetryPolicy(rp), WithMetricsWriter(&buf))
+	if _, err := testProcessor.Process(context.Background(), startTime, metric); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected a single line of metrics, got %q", buf.String())
+	}
+	var doc struct {
+		AWS struct {
+			Timestamp         int64
+			CloudWatchMetrics []emfDirective
+		} `json:"_aws"`
+		MetricKey        string
+		SamplesExported  int
+		WindowsProcessed int
+		APIErrors        int
+		CheckpointLag    *float64
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &doc); err != nil {
+		t.Fatalf("failed to unmarshal metrics: %v", err)
+	}
+	if doc.MetricKey != "AWS/Lambda/Invocations/Sum/60" {
+		t.Errorf("unexpected metric key %q", doc.MetricKey)
+	}
+	if doc.SamplesExported != 4 || doc.WindowsProcessed != 2 || doc.APIErrors != 1 {
+		t.Errorf("expected 4 samples, 2 windows and 1 error, got %d samples, %d windows and %d errors", doc.SamplesExported, doc.WindowsProcessed, doc.APIErrors)
+	}
+	if doc.CheckpointLag == nil || *doc.CheckpointLag < 0 || *doc.CheckpointLag > Interval.Seconds() {
+		t.Errorf("expected a lag of less than an interval, got %v", doc.CheckpointLag)
+	}
+	if doc.AWS.Timestamp == 0 || len(doc.AWS.CloudWatchMetrics) != 1 {
+		t.Fatalf("expected EMF metadata, got %+v", doc.AWS)
+	}
+	directive := doc.AWS.CloudWatchMetrics[0]
+	if directive.Namespace != MetricsNamespace || len(directive.Dimensions) != 1 || directive.Dimensions[0][0] != MetricKeyDimension {
+		t.Errorf("unexpected directive %+v", directive)
+	}
+	if len(directive.Metrics) != 4 {
+		t.Errorf("expected 4 metrics, got %+v", directive.Metrics)
+	}
+}
+
+func TestProcessMetricsWithoutCheckpoint(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	metric := &types.MetricStat{
+		Metric: &types.Metric{
+			Namespace:  aws.String("AWS/Lambda"),
+			MetricName: aws.String("Invocations"),
+		},
+		Stat:   aws.String("Sum"),
+		Period: aws.Int32(60),
+	}
+	var buf bytes.Buffer
+	testProcessor, _ := New(logger, &mockMetricStore{}, nil, &mockCloudwatch{}, WithLease(&mockLeaser{owner: "other", expires: time.Now().Add(time.Minute)}, time.Minute), WithMetricsWriter(&buf))
+	res, err := testProcessor.Process(context.Background(), time.Now(), metric)
+	if err != nil || !res.Skipped {
+		t.Fatalf("expected processing to be skipped, got %v, %v", res, err)
+	}
+	if strings.Contains(buf.String(), CheckpointLagMetric) {
+		t.Errorf("expected no lag when the checkpoint wasn't read, got %q", buf.String())
+	}
+}
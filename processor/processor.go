@@ -2,57 +2,429 @@ package processor
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/a-h/cwexport/cw"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
-const interval = time.Minute
+// Interval is the size of the window of samples requested from CloudWatch on each iteration.
+const Interval = time.Minute
 
 type MetricPutter func(ctx context.Context, ms []MetricSample) error
 
+// PartialPutError is returned by a MetricPutter when only some of the samples were put. When the
+// put is retried, only the failed samples are put again, so that the others aren't duplicated.
+type PartialPutError struct {
+	// Failed are the samples that weren't put.
+	Failed []MetricSample
+	// Err is the cause of the failures, which decides whether the put is retried.
+	Err error
+}
+
+func (e *PartialPutError) Error() string {
+	return fmt.Sprintf("failed to put %d samples: %v", len(e.Failed), e.Err)
+}
+
+func (e *PartialPutError) Unwrap() error {
+	return e.Err
+}
+
+// ErrCheckpointConflict is returned by a MetricStore when a checkpoint can't be moved forward, because
+// another processor has already moved it to the same or a later position.
+var ErrCheckpointConflict = errors.New("checkpoint conflict")
+
 type MetricStore interface {
 	Get(ctx context.Context, m *types.MetricStat) (lastStart time.Time, ok bool, err error)
 	Put(ctx context.Context, m *types.MetricStat, lastStart time.Time) (err error)
 }
+
+// Leaser prevents more than one processor from exporting the same metric at the same time.
+type Leaser interface {
+	AcquireLease(ctx context.Context, m *types.MetricStat, owner string, expires time.Time) (ok bool, err error)
+	ReleaseLease(ctx context.Context, m *types.MetricStat, owner string) (err error)
+}
+
+// Run is a record of a call to Process.
+type Run struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Result   Result    `json:"result"`
+	// Error is the error that stopped processing, or empty if processing succeeded.
+	Error string `json:"error,omitempty"`
+}
+
+// Duration is how long the run took.
+func (r Run) Duration() time.Duration {
+	return r.Finished.Sub(r.Started)
+}
+
+// Status summarises the recent runs of a metric.
+type Status struct {
+	LastRun             time.Time `json:"lastRun"`
+	LastSuccess         time.Time `json:"lastSuccess"`
+	LastFailure         time.Time `json:"lastFailure"`
+	LastError           string    `json:"lastError,omitempty"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+}
+
+// RunRecorder keeps a history of runs, and the status of each metric.
+type RunRecorder interface {
+	RecordRun(ctx context.Context, m *types.MetricStat, run Run) (err error)
+}
+
+// StatusReader reads the status of each metric, kept by a RunRecorder. If the metric has never
+// been run, ok is false.
+type StatusReader interface {
+	GetStatus(ctx context.Context, m *types.MetricStat) (status Status, ok bool, err error)
+}
+
 type MetricGetter interface {
-	GetSamples(metric *types.MetricStat, start time.Time, end time.Time) (samples []cw.Sample, err error)
+	GetSamples(ctx context.Context, metric *types.MetricStat, start time.Time, end time.Time) (samples []cw.Sample, err error)
+}
+
+type OptionsFunc func(*Processor)
+
+// WithPublicationDelay stops the processor from exporting a window until the delay has passed
+// since the window closed, giving CloudWatch time to publish late samples.
+func WithPublicationDelay(d time.Duration) OptionsFunc {
+	return func(p *Processor) {
+		p.delay = d
+	}
+}
+
+// WithDeadlineMargin sets how much time to leave before the context deadline when deciding whether
+// there's time to process another window. Defaults to 5 seconds.
+func WithDeadlineMargin(d time.Duration) OptionsFunc {
+	return func(p *Processor) {
+		p.deadlineMargin = d
+	}
+}
+
+// WithLease takes a lease on the metric before processing it, and skips processing if another
+// processor holds the lease. Processing stops before the lease expires after the given duration.
+func WithLease(leaser Leaser, duration time.Duration) OptionsFunc {
+	return func(p *Processor) {
+		p.leaser = leaser
+		p.leaseDuration = duration
+	}
+}
+
+// WithRunRecorder records each run of the processor, apart from runs that are skipped because
+// another processor holds the lease.
+func WithRunRecorder(recorder RunRecorder) OptionsFunc {
+	return func(p *Processor) {
+		p.recorder = recorder
+	}
+}
+
+// WithConcurrency sets how many metrics ProcessAll processes at the same time. Defaults to 10.
+func WithConcurrency(n int) OptionsFunc {
+	return func(p *Processor) {
+		p.concurrency = n
+	}
 }
 
 type Processor struct {
-	logger     *zap.Logger
-	putMetrics MetricPutter
-	store      MetricStore
-	getter     MetricGetter
+	logger         *zap.Logger
+	putMetrics     MetricPutter
+	store          MetricStore
+	getter         MetricGetter
+	delay          time.Duration
+	deadlineMargin time.Duration
+	retryPolicy    RetryPolicy
+	leaser         Leaser
+	leaseDuration  time.Duration
+	recorder       RunRecorder
+	concurrency    int
+	metrics        *metricsWriter
+	source         cw.Source
 }
 
 type MetricSample struct {
 	Source string `json:"src"`
+	// Account is the account that the metric was read from, if it isn't the default account.
+	Account string `json:"account,omitempty"`
+	// Region is the region that the metric was read from, if it isn't the default region.
+	Region string `json:"region,omitempty"`
 	*types.MetricStat
 	cw.Sample `json:"sample"`
 }
 
-func New(logger *zap.Logger, store MetricStore, putter MetricPutter, getter MetricGetter) (Processor, error) {
-	return Processor{
-		logger:     logger,
-		putMetrics: putter,
-		store:      store,
-		getter:     getter,
-	}, nil
+func New(logger *zap.Logger, store MetricStore, putter MetricPutter, getter MetricGetter, options ...OptionsFunc) (p Processor, err error) {
+	p = Processor{
+		logger:         logger,
+		putMetrics:     putter,
+		store:          store,
+		getter:         getter,
+		deadlineMargin: 5 * time.Second,
+		retryPolicy:    DefaultRetryPolicy,
+		concurrency:    10,
+	}
+	for _, o := range options {
+		o(&p)
+	}
+	return p, nil
+}
+
+// MetricKey returns the canonical key of a metric, made up of its namespace, dimensions, name, stat
+// and period, e.g. "ns/ServiceName/auth/logins/Sum/300". Stores use it to identify checkpoints.
+func MetricKey(m *types.MetricStat) string {
+	var sb strings.Builder
+	sb.WriteString(*m.Metric.Namespace)
+	sb.WriteRune('/')
+	for _, d := range m.Metric.Dimensions {
+		sb.WriteString(*d.Name)
+		sb.WriteRune('/')
+		sb.WriteString(*d.Value)
+		sb.WriteRune('/')
+	}
+	sb.WriteString(*m.Metric.MetricName)
+	sb.WriteRune('/')
+	sb.WriteString(*m.Stat)
+	sb.WriteRune('/')
+	sb.WriteString(strconv.FormatInt(int64(*m.Period), 10))
+	return sb.String()
+}
+
+// ProcessAll processes each of the metrics, with up to the processor's concurrency limit in progress
+// at the same time. The results are in the same order as the metrics. If any metric fails, the
+// error lists each failure, and the other metrics are still processed.
+func (p Processor) ProcessAll(ctx context.Context, startTime time.Time, metrics []types.MetricStat) (results []Result, err error) {
+	results = make([]Result, len(metrics))
+	errs := make([]error, len(metrics))
+	concurrency := p.concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range metrics {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			mp := p
+			mp.logger = p.logger.With(zap.String("metric", SourceMetricKey(p.source, &metrics[i])))
+			results[i], errs[i] = mp.Process(ctx, startTime, &metrics[i])
+		}(i)
+	}
+	wg.Wait()
+	var failures []string
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", SourceMetricKey(p.source, &metrics[i]), err))
+		}
+	}
+	if len(failures) > 0 {
+		err = fmt.Errorf("%d of %d metrics failed: %s", len(failures), len(metrics), strings.Join(failures, "; "))
+	}
+	return
 }
 
 func getIntervalCount(startTime time.Time, endTime time.Time) int {
 	duration := endTime.Sub(startTime)
-	return int(duration / interval)
+	return int(duration / Interval)
+}
+
+// Window is a time range of samples requested from CloudWatch.
+type Window struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// WindowError is an error that occurred while processing a window.
+type WindowError struct {
+	Window
+	Error string `json:"error"`
+}
+
+// Result reports how far a call to Process got.
+type Result struct {
+	// WindowCount is the number of windows that were exported.
+	WindowCount int `json:"windowCount"`
+	// SampleCount is the number of samples that were sent to the putter.
+	SampleCount int `json:"sampleCount"`
+	// FirstWindow is the first window that was exported, or nil if no windows were exported.
+	FirstWindow *Window `json:"firstWindow,omitempty"`
+	// LastWindow is the last window that was exported, or nil if no windows were exported.
+	LastWindow *Window `json:"lastWindow,omitempty"`
+	// Position is the end of the last exported window, where the next run will start from.
+	Position time.Time `json:"position"`
+	// Lag is how far Position is behind the time that processing finished.
+	Lag time.Duration `json:"lag"`
+	// DeadlineReached is true if processing stopped early, because the context deadline was too close
+	// to process another window.
+	DeadlineReached bool `json:"deadlineReached"`
+	// Skipped is true if the metric wasn't processed, because another processor holds the lease.
+	Skipped bool `json:"skipped"`
+	// Conflict is true if processing stopped, because another processor moved the checkpoint.
+	Conflict bool `json:"conflict"`
+	// Errors that occurred while processing windows, including transient errors that were retried.
+	Errors []WindowError `json:"errors,omitempty"`
+}
+
+func (r Result) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "exported %d windows", r.WindowCount)
+	if r.FirstWindow != nil && r.LastWindow != nil {
+		fmt.Fprintf(&sb, " (%s to %s)", r.FirstWindow.Start.Format(time.RFC3339), r.LastWindow.End.Format(time.RFC3339))
+	}
+	fmt.Fprintf(&sb, ", %d samples, position %s, lag %s", r.SampleCount, r.Position.Format(time.RFC3339), r.Lag.Round(time.Second))
+	if r.DeadlineReached {
+		sb.WriteString(", stopped before deadline")
+	}
+	if r.Skipped {
+		sb.WriteString(", skipped because the metric is leased by another processor")
+	}
+	if r.Conflict {
+		sb.WriteString(", stopped because another processor moved the checkpoint")
+	}
+	for _, e := range r.Errors {
+		fmt.Fprintf(&sb, "\nerror in window %s to %s: %s", e.Start.Format(time.RFC3339), e.End.Format(time.RFC3339), e.Error)
+	}
+	return sb.String()
+}
+
+func (r *Result) addError(w Window, err error) {
+	r.Errors = append(r.Errors, WindowError{
+		Window: w,
+		Error:  err.Error(),
+	})
+}
+
+// deadlineReached returns true if there isn't enough time before the context deadline to process
+// a window that takes as long as the slowest window so far.
+func (p Processor) deadlineReached(ctx context.Context, slowest time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return false
+	}
+	return time.Until(deadline) < p.deadlineMargin+slowest
 }
 
-func (p Processor) Process(ctx context.Context, startTime time.Time, metric *types.MetricStat) error {
-	lst, ok, err := p.store.Get(ctx, metric)
+// retry calls f using the processor's retry policy, logging each retried error.
+func (p Processor) retry(ctx context.Context, logger *zap.Logger, onRetry func(err error), f func() error) error {
+	return p.retryPolicy.do(ctx, func(attempt int, err error, delay time.Duration) {
+		logger.Warn("Retrying after transient error", zap.Int("attempt", attempt), zap.Duration("delay", delay), zap.Error(err))
+		onRetry(err)
+	}, f)
+}
+
+// lease takes the lease on the metric. If the lease is taken, the returned context has a deadline
+// before the lease expires, and release must be called when processing is complete.
+func (p Processor) lease(ctx context.Context, metric *types.MetricStat, onRetry func(err error)) (leaseCtx context.Context, release func(), ok bool, err error) {
+	owner := uuid.New().String()
+	expires := time.Now().Add(p.leaseDuration)
+	err = p.retry(ctx, p.logger, onRetry, func() (err error) {
+		ok, err = p.leaser.AcquireLease(ctx, metric, owner, expires)
+		return err
+	})
+	if err != nil || !ok {
+		return
+	}
+	leaseCtx, cancel := context.WithDeadline(ctx, expires)
+	release = func() {
+		cancel()
+		// Release the lease even if the processing context has been cancelled.
+		releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := p.leaser.ReleaseLease(releaseCtx, metric, owner); err != nil {
+			p.logger.Warn("Failed to release lease, it will expire", zap.Time("expires", expires), zap.Error(err))
+		}
+	}
+	return
+}
+
+func (p Processor) recordRun(metric *types.MetricStat, started time.Time, res Result, err error) {
+	run := Run{
+		Started:  started,
+		Finished: time.Now(),
+		Result:   res,
+	}
 	if err != nil {
-		p.logger.Error("Failed to get last start time from store", zap.Error(err))
+		run.Error = err.Error()
+		// A run with an empty error is a success, so describe errors without a message by their type.
+		if run.Error == "" {
+			run.Error = fmt.Sprintf("%T", err)
+		}
+	}
+	// Record the run even if processing was cancelled.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.recorder.RecordRun(ctx, metric, run); err != nil {
+		p.logger.Warn("Failed to record run", zap.Error(err))
+	}
+}
+
+func (p Processor) Process(ctx context.Context, startTime time.Time, metric *types.MetricStat) (res Result, err error) {
+	// The store identifies the metric by its source, the getter reads it from the source.
+	scoped := metric
+	if metric != nil {
+		scoped = ScopedMetric(p.source, metric)
+	}
+	// Count every failed call, including the ones that are retried.
+	var apiErrors int
+	countError := func(error) {
+		apiErrors++
+	}
+	var positionKnown bool
+	if p.metrics != nil {
+		defer func() {
+			rm := runMetrics{
+				key:       MetricKey(scoped),
+				samples:   res.SampleCount,
+				windows:   res.WindowCount,
+				apiErrors: apiErrors,
+			}
+			if positionKnown {
+				rm.lag = &res.Lag
+			}
+			p.metrics.write(p.logger, rm)
+		}()
+	}
+	if p.leaser != nil {
+		var release func()
+		var ok bool
+		ctx, release, ok, err = p.lease(ctx, scoped, countError)
+		if err != nil {
+			countError(err)
+			p.logger.Error("Failed to acquire lease", zap.Error(err))
+			return
+		}
+		if !ok {
+			p.logger.Info("Skipping processing, another processor holds the lease")
+			res.Skipped = true
+			return
+		}
+		defer release()
+	}
+	if p.recorder != nil {
+		started := time.Now()
+		defer func() {
+			p.recordRun(scoped, started, res, err)
+		}()
+	}
+	var lst time.Time
+	var ok bool
+	err = p.retry(ctx, p.logger, countError, func() (err error) {
+		lst, ok, err = p.store.Get(ctx, scoped)
 		return err
+	})
+	if err != nil {
+		countError(err)
+		p.logger.Error("Failed to get last start time from store", zap.Error(err))
+		return
 	}
 	if !ok {
 		p.logger.Info("No start time found...")
@@ -60,23 +432,49 @@ func (p Processor) Process(ctx context.Context, startTime time.Time, metric *typ
 		p.logger.Info("Last start time found", zap.Time("startTime", lst))
 		startTime = lst
 	}
+	res.Position = startTime
+	positionKnown = true
+	defer func() {
+		res.Lag = time.Since(res.Position)
+	}()
 
-	ic := getIntervalCount(startTime, time.Now())
+	ic := getIntervalCount(startTime, time.Now().Add(-p.delay))
 	if ic > 120 {
 		ic = 120
 	}
+	var slowest time.Duration
 	for i := 0; i < ic; i++ {
-		start := startTime.Add(time.Duration(i) * interval)
-		end := start.Add(interval)
+		start := startTime.Add(time.Duration(i) * Interval)
+		end := start.Add(Interval)
+		window := Window{Start: start, End: end}
 		logger := p.logger.With(
 			zap.Time("startTime", start),
 			zap.Time("endTime", end),
 		)
+		if err = ctx.Err(); err != nil {
+			logger.Info("Processing cancelled", zap.Error(err))
+			return
+		}
+		if p.deadlineReached(ctx, slowest) {
+			logger.Warn("Stopping before the deadline, the remaining intervals will be processed on the next run")
+			res.DeadlineReached = true
+			return
+		}
+		windowStarted := time.Now()
+		onError := func(err error) {
+			countError(err)
+			res.addError(window, err)
+		}
 		logger.Info("Getting metrics for period")
-		samples, err := p.getter.GetSamples(metric, start, end)
+		var samples []cw.Sample
+		err = p.retry(ctx, logger, onError, func() (err error) {
+			samples, err = p.getter.GetSamples(ctx, metric, start, end)
+			return err
+		})
 		if err != nil {
 			logger.Error("Failed to get metrics for interval", zap.Error(err))
-			return err
+			onError(err)
+			return
 		}
 		logger.Info("Got metrics for period", zap.Int("metricCount", len(samples)))
 
@@ -85,25 +483,56 @@ func (p Processor) Process(ctx context.Context, startTime time.Time, metric *typ
 		for _, s := range samples {
 			metricSamples = append(metricSamples, MetricSample{
 				Source:     "cwexport",
+				Account:    p.source.Account(),
+				Region:     p.source.Region,
 				MetricStat: metric,
 				Sample:     s,
 			})
 		}
 
-		err = p.putMetrics(ctx, metricSamples)
+		pending := metricSamples
+		err = p.retry(ctx, logger, onError, func() error {
+			err := p.putMetrics(ctx, pending)
+			var partial *PartialPutError
+			if errors.As(err, &partial) {
+				pending = partial.Failed
+			}
+			return err
+		})
 		if err != nil {
 			logger.Error("Failed to send data to firehose", zap.Error(err))
-			return err
+			onError(err)
+			return
 		}
 
 		logger.Info("Saving the last runtime in the database")
-		err = p.store.Put(ctx, metric, end)
+		err = p.retry(ctx, logger, onError, func() error {
+			return p.store.Put(ctx, scoped, end)
+		})
+		if errors.Is(err, ErrCheckpointConflict) {
+			// Another processor has exported this window, leave the rest to it.
+			logger.Info("Stopping, the checkpoint has been moved by another processor", zap.Error(err))
+			res.Conflict = true
+			err = nil
+			return
+		}
 		if err != nil {
 			logger.Error("Failed to save last end time to table", zap.Error(err))
-			return err
+			onError(err)
+			return
+		}
+		res.Position = end
+		res.WindowCount++
+		res.SampleCount += len(metricSamples)
+		if res.FirstWindow == nil {
+			res.FirstWindow = &window
+		}
+		res.LastWindow = &window
+		if d := time.Since(windowStarted); d > slowest {
+			slowest = d
 		}
 		logger.Info("Successfully processed interval :)")
 	}
 	p.logger.Info("Successfully completed all intervals :)", zap.Int("intervalCount", ic))
-	return nil
+	return
 }
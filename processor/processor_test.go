@@ -2,10 +2,15 @@ package processor
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/a-h/cwexport/cw"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 	"go.uber.org/zap"
 )
@@ -14,6 +19,7 @@ type mockMetricStore struct {
 	endTime         time.Time
 	lastStartDate   time.Time
 	lastStartDateOk bool
+	putErr          error
 }
 
 type mockCloudwatch struct {
@@ -25,11 +31,14 @@ func (store *mockMetricStore) Get(ctx context.Context, m *types.MetricStat) (las
 }
 
 func (store *mockMetricStore) Put(ctx context.Context, m *types.MetricStat, endTime time.Time) (err error) {
+	if store.putErr != nil {
+		return store.putErr
+	}
 	store.endTime = endTime
 	return
 }
 
-func (m *mockCloudwatch) GetSamples(metric *types.MetricStat, start time.Time, end time.Time) (samples []cw.Sample, err error) {
+func (m *mockCloudwatch) GetSamples(ctx context.Context, metric *types.MetricStat, start time.Time, end time.Time) (samples []cw.Sample, err error) {
 	return m.samples, nil
 }
 
@@ -141,7 +150,7 @@ func TestProcess(t *testing.T) {
 			}
 
 			testProcessor, _ := New(logger, &store, metricPutter, &mockCloudwatch{samples: tC.samples})
-			_ = testProcessor.Process(context.TODO(), tC.startTime, nil)
+			_, _ = testProcessor.Process(context.TODO(), tC.startTime, nil)
 
 			if !store.endTime.Equal(tC.expectedEndtime) {
 				t.Errorf("Expected end time does not match - got %v expected %v", store.endTime, tC.expectedEndtime)
@@ -153,3 +162,441 @@ func TestProcess(t *testing.T) {
 		})
 	}
 }
+
+func TestProcessCancellation(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	ctx, cancel := context.WithCancel(context.Background())
+	var puts int
+	metricPutter := func(ctx context.Context, ms []MetricSample) error {
+		puts++
+		if puts == 3 {
+			cancel()
+		}
+		return nil
+	}
+	store := mockMetricStore{}
+	startTime := time.Now().Add(-10 * Interval)
+
+	testProcessor, _ := New(logger, &store, metricPutter, &mockCloudwatch{})
+	_, err := testProcessor.Process(ctx, startTime, nil)
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if puts != 3 {
+		t.Errorf("expected processing to stop after 3 intervals, got %d", puts)
+	}
+	if expected := startTime.Add(3 * Interval); !store.endTime.Equal(expected) {
+		t.Errorf("expected the position of the last completed interval %v to be stored, got %v", expected, store.endTime)
+	}
+}
+
+func TestProcessPublicationDelay(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	var puts int
+	metricPutter := func(ctx context.Context, ms []MetricSample) error {
+		puts++
+		return nil
+	}
+	store := mockMetricStore{}
+	startTime := time.Now().Add(-10 * Interval)
+
+	testProcessor, _ := New(logger, &store, metricPutter, &mockCloudwatch{}, WithPublicationDelay(5*Interval))
+	_, err := testProcessor.Process(context.Background(), startTime, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if puts != 5 {
+		t.Errorf("expected intervals within the publication delay to be skipped, but %d were processed", puts)
+	}
+}
+
+func TestProcessDeadline(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	var puts int
+	metricPutter := func(ctx context.Context, ms []MetricSample) error {
+		puts++
+		// Simulate a slow window.
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}
+	store := mockMetricStore{}
+	startTime := time.Now().Add(-10 * Interval).Truncate(Interval)
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+
+	testProcessor, _ := New(logger, &store, metricPutter, &mockCloudwatch{}, WithDeadlineMargin(50*time.Millisecond))
+	res, err := testProcessor.Process(ctx, startTime, nil)
+	if err != nil {
+		t.Fatalf("expected processing to stop cleanly, got %v", err)
+	}
+	if !res.DeadlineReached {
+		t.Error("expected the deadline to be reached")
+	}
+	if puts == 0 || puts >= 10 {
+		t.Errorf("expected some, but not all intervals to be processed, got %d", puts)
+	}
+	if expected := startTime.Add(time.Duration(puts) * Interval); !res.Position.Equal(expected) || !store.endTime.Equal(expected) {
+		t.Errorf("expected position %v, got result %v and stored %v", expected, res.Position, store.endTime)
+	}
+	if res.Lag < time.Duration(10-puts)*Interval {
+		t.Errorf("expected the lag to include the unprocessed intervals, got %v", res.Lag)
+	}
+	if ctx.Err() != nil {
+		t.Error("expected processing to stop before the deadline")
+	}
+}
+
+func TestProcessResult(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	startTime := time.Now().Add(-3 * Interval).Truncate(Interval)
+	samples := []cw.Sample{{Time: startTime, Value: 1}, {Time: startTime, Value: 2}}
+
+	t.Run("successful windows are counted", func(t *testing.T) {
+		store := mockMetricStore{}
+		metricPutter := func(ctx context.Context, ms []MetricSample) error { return nil }
+		testProcessor, _ := New(logger, &store, metricPutter, &mockCloudwatch{samples: samples})
+		res, err := testProcessor.Process(context.Background(), startTime, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if res.WindowCount != 3 {
+			t.Errorf("expected 3 windows, got %d", res.WindowCount)
+		}
+		if res.SampleCount != 6 {
+			t.Errorf("expected 6 samples, got %d", res.SampleCount)
+		}
+		if res.FirstWindow == nil || !res.FirstWindow.Start.Equal(startTime) {
+			t.Errorf("expected the first window to start at %v, got %v", startTime, res.FirstWindow)
+		}
+		if expected := startTime.Add(3 * Interval); res.LastWindow == nil || !res.LastWindow.End.Equal(expected) {
+			t.Errorf("expected the last window to end at %v, got %v", expected, res.LastWindow)
+		}
+		if len(res.Errors) != 0 {
+			t.Errorf("expected no errors, got %v", res.Errors)
+		}
+	})
+	t.Run("failed windows are recorded", func(t *testing.T) {
+		store := mockMetricStore{}
+		var puts int
+		metricPutter := func(ctx context.Context, ms []MetricSample) error {
+			puts++
+			if puts == 2 {
+				return errors.New("firehose unavailable")
+			}
+			return nil
+		}
+		testProcessor, _ := New(logger, &store, metricPutter, &mockCloudwatch{samples: samples})
+		res, err := testProcessor.Process(context.Background(), startTime, nil)
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if res.WindowCount != 1 {
+			t.Errorf("expected 1 window, got %d", res.WindowCount)
+		}
+		if len(res.Errors) != 1 {
+			t.Fatalf("expected 1 error, got %v", res.Errors)
+		}
+		if expected := startTime.Add(Interval); !res.Errors[0].Start.Equal(expected) {
+			t.Errorf("expected the error to be in the window starting at %v, got %v", expected, res.Errors[0].Start)
+		}
+		if res.Errors[0].Error != "firehose unavailable" {
+			t.Errorf("unexpected error message %q", res.Errors[0].Error)
+		}
+	})
+}
+
+type mockLeaser struct {
+	owner    string
+	expires  time.Time
+	released bool
+}
+
+func (l *mockLeaser) AcquireLease(ctx context.Context, m *types.MetricStat, owner string, expires time.Time) (ok bool, err error) {
+	if l.owner != "" && l.owner != owner && l.expires.After(time.Now()) {
+		return false, nil
+	}
+	l.owner = owner
+	l.expires = expires
+	return true, nil
+}
+
+func (l *mockLeaser) ReleaseLease(ctx context.Context, m *types.MetricStat, owner string) (err error) {
+	if l.owner == owner {
+		l.owner = ""
+		l.released = true
+	}
+	return nil
+}
+
+func TestProcessLease(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	startTime := time.Now().Add(-2 * Interval).Truncate(Interval)
+
+	t.Run("the lease is released after processing", func(t *testing.T) {
+		leaser := &mockLeaser{}
+		var deadline time.Time
+		metricPutter := func(ctx context.Context, ms []MetricSample) error {
+			deadline, _ = ctx.Deadline()
+			return nil
+		}
+		testProcessor, _ := New(logger, &mockMetricStore{}, metricPutter, &mockCloudwatch{}, WithLease(leaser, time.Minute))
+		res, err := testProcessor.Process(context.Background(), startTime, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if res.Skipped || res.WindowCount != 2 {
+			t.Errorf("expected 2 windows to be processed, got %v", res)
+		}
+		if !leaser.released {
+			t.Error("expected the lease to be released")
+		}
+		if !deadline.Equal(leaser.expires) {
+			t.Errorf("expected processing to have a deadline of the lease expiry %v, got %v", leaser.expires, deadline)
+		}
+	})
+	t.Run("processing is skipped if another processor holds the lease", func(t *testing.T) {
+		leaser := &mockLeaser{
+			owner:   "another",
+			expires: time.Now().Add(time.Minute),
+		}
+		var puts int
+		metricPutter := func(ctx context.Context, ms []MetricSample) error {
+			puts++
+			return nil
+		}
+		store := mockMetricStore{}
+		testProcessor, _ := New(logger, &store, metricPutter, &mockCloudwatch{}, WithLease(leaser, time.Minute))
+		res, err := testProcessor.Process(context.Background(), startTime, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !res.Skipped {
+			t.Error("expected processing to be skipped")
+		}
+		if puts != 0 {
+			t.Errorf("expected no windows to be processed, got %d", puts)
+		}
+		if leaser.owner != "another" {
+			t.Error("expected the other processor's lease to be left in place")
+		}
+	})
+}
+
+func TestProcessCheckpointConflict(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	startTime := time.Now().Add(-3 * Interval).Truncate(Interval)
+	var puts int
+	metricPutter := func(ctx context.Context, ms []MetricSample) error {
+		puts++
+		return nil
+	}
+	store := mockMetricStore{
+		putErr: fmt.Errorf("%w: moved by another processor", ErrCheckpointConflict),
+	}
+	testProcessor, _ := New(logger, &store, metricPutter, &mockCloudwatch{})
+	res, err := testProcessor.Process(context.Background(), startTime, nil)
+	if err != nil {
+		t.Fatalf("expected processing to stop quietly, got %v", err)
+	}
+	if !res.Conflict {
+		t.Error("expected a conflict to be reported")
+	}
+	if puts != 1 {
+		t.Errorf("expected processing to stop after the first window, got %d windows", puts)
+	}
+	if res.WindowCount != 0 || !res.Position.Equal(startTime) {
+		t.Errorf("expected the position not to move, got %v", res)
+	}
+}
+
+type mockRunRecorder struct {
+	runs []Run
+}
+
+func (r *mockRunRecorder) RecordRun(ctx context.Context, m *types.MetricStat, run Run) (err error) {
+	r.runs = append(r.runs, run)
+	return nil
+}
+
+func TestProcessRunRecorder(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	startTime := time.Now().Add(-2 * Interval).Truncate(Interval)
+	samples := []cw.Sample{{Time: startTime, Value: 1}}
+
+	t.Run("successful runs are recorded", func(t *testing.T) {
+		recorder := &mockRunRecorder{}
+		metricPutter := func(ctx context.Context, ms []MetricSample) error { return nil }
+		testProcessor, _ := New(logger, &mockMetricStore{}, metricPutter, &mockCloudwatch{samples: samples}, WithRunRecorder(recorder))
+		_, _ = testProcessor.Process(context.Background(), startTime, nil)
+		if len(recorder.runs) != 1 {
+			t.Fatalf("expected 1 run to be recorded, got %d", len(recorder.runs))
+		}
+		run := recorder.runs[0]
+		if run.Error != "" {
+			t.Errorf("expected no error, got %q", run.Error)
+		}
+		if run.Result.SampleCount != 2 || run.Result.WindowCount != 2 {
+			t.Errorf("expected the result to be recorded, got %v", run.Result)
+		}
+		if run.Result.Lag == 0 {
+			t.Error("expected the lag to be recorded")
+		}
+		if run.Finished.Before(run.Started) {
+			t.Errorf("expected the run to finish after it started, got %v to %v", run.Started, run.Finished)
+		}
+	})
+	t.Run("failed runs are recorded", func(t *testing.T) {
+		recorder := &mockRunRecorder{}
+		metricPutter := func(ctx context.Context, ms []MetricSample) error { return errors.New("firehose unavailable") }
+		testProcessor, _ := New(logger, &mockMetricStore{}, metricPutter, &mockCloudwatch{samples: samples}, WithRunRecorder(recorder))
+		_, _ = testProcessor.Process(context.Background(), startTime, nil)
+		if len(recorder.runs) != 1 {
+			t.Fatalf("expected 1 run to be recorded, got %d", len(recorder.runs))
+		}
+		if recorder.runs[0].Error != "firehose unavailable" {
+			t.Errorf("expected the error to be recorded, got %q", recorder.runs[0].Error)
+		}
+	})
+	t.Run("failed runs are recorded when the error has no message", func(t *testing.T) {
+		recorder := &mockRunRecorder{}
+		metricPutter := func(ctx context.Context, ms []MetricSample) error { return errors.New("") }
+		testProcessor, _ := New(logger, &mockMetricStore{}, metricPutter, &mockCloudwatch{samples: samples}, WithRunRecorder(recorder), WithRetryPolicy(NoRetryPolicy))
+		_, _ = testProcessor.Process(context.Background(), startTime, nil)
+		if len(recorder.runs) != 1 {
+			t.Fatalf("expected 1 run to be recorded, got %d", len(recorder.runs))
+		}
+		if recorder.runs[0].Error == "" {
+			t.Error("expected the run to be recorded as a failure")
+		}
+	})
+	t.Run("skipped runs are not recorded", func(t *testing.T) {
+		recorder := &mockRunRecorder{}
+		leaser := &mockLeaser{owner: "another", expires: time.Now().Add(time.Minute)}
+		metricPutter := func(ctx context.Context, ms []MetricSample) error { return nil }
+		testProcessor, _ := New(logger, &mockMetricStore{}, metricPutter, &mockCloudwatch{}, WithLease(leaser, time.Minute), WithRunRecorder(recorder))
+		_, _ = testProcessor.Process(context.Background(), startTime, nil)
+		if len(recorder.runs) != 0 {
+			t.Fatalf("expected no runs to be recorded, got %d", len(recorder.runs))
+		}
+	})
+}
+
+func TestMetricKey(t *testing.T) {
+	m := &types.MetricStat{
+		Metric: &types.Metric{
+			Namespace:  aws.String("ns"),
+			MetricName: aws.String("logins"),
+			Dimensions: []types.Dimension{
+				{Name: aws.String("ServiceName"), Value: aws.String("auth")},
+			},
+		},
+		Period: aws.Int32(300),
+		Stat:   aws.String("Sum"),
+	}
+	if actual := MetricKey(m); actual != "ns/ServiceName/auth/logins/Sum/300" {
+		t.Errorf("unexpected key %q", actual)
+	}
+}
+
+// concurrentMetricStore keeps a checkpoint per metric, and is safe for concurrent use.
+type concurrentMetricStore struct {
+	m           sync.Mutex
+	checkpoints map[string]time.Time
+}
+
+func (store *concurrentMetricStore) Get(ctx context.Context, m *types.MetricStat) (lastStart time.Time, ok bool, err error) {
+	store.m.Lock()
+	defer store.m.Unlock()
+	lastStart, ok = store.checkpoints[MetricKey(m)]
+	return
+}
+
+func (store *concurrentMetricStore) Put(ctx context.Context, m *types.MetricStat, lastStart time.Time) (err error) {
+	store.m.Lock()
+	defer store.m.Unlock()
+	store.checkpoints[MetricKey(m)] = lastStart
+	return
+}
+
+// concurrentCloudwatch records the highest number of concurrent requests, and fails requests
+// for the metric named "broken".
+type concurrentCloudwatch struct {
+	m       sync.Mutex
+	current int
+	max     int
+}
+
+func (c *concurrentCloudwatch) GetSamples(ctx context.Context, metric *types.MetricStat, start time.Time, end time.Time) (samples []cw.Sample, err error) {
+	c.m.Lock()
+	c.current++
+	if c.current > c.max {
+		c.max = c.current
+	}
+	c.m.Unlock()
+	time.Sleep(time.Millisecond)
+	c.m.Lock()
+	c.current--
+	c.m.Unlock()
+	if *metric.Metric.MetricName == "broken" {
+		return nil, errors.New("broken")
+	}
+	return []cw.Sample{{Time: start, Value: 1}}, nil
+}
+
+func TestProcessAll(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	startTime := time.Now().Add(-3 * Interval).Truncate(Interval)
+	var metrics []types.MetricStat
+	for i := 0; i < 20; i++ {
+		metrics = append(metrics, types.MetricStat{
+			Metric: &types.Metric{
+				Namespace:  aws.String("ns"),
+				MetricName: aws.String(fmt.Sprintf("metric%d", i)),
+			},
+			Period: aws.Int32(60),
+			Stat:   aws.String("Sum"),
+		})
+	}
+	metrics[5].Metric.MetricName = aws.String("broken")
+
+	var m sync.Mutex
+	var samples int
+	metricPutter := func(ctx context.Context, ms []MetricSample) error {
+		m.Lock()
+		defer m.Unlock()
+		samples += len(ms)
+		return nil
+	}
+	store := &concurrentMetricStore{checkpoints: map[string]time.Time{}}
+	getter := &concurrentCloudwatch{}
+	testProcessor, _ := New(logger, store, metricPutter, getter,
+		WithConcurrency(4),
+		WithRetryPolicy(NoRetryPolicy))
+	results, err := testProcessor.ProcessAll(context.Background(), startTime, metrics)
+	if err == nil || !strings.Contains(err.Error(), "1 of 20 metrics failed: ns/broken/Sum/60") {
+		t.Errorf("expected the broken metric to be reported, got %v", err)
+	}
+	if len(results) != len(metrics) {
+		t.Fatalf("expected a result for each metric, got %d", len(results))
+	}
+	for i, res := range results {
+		if i == 5 {
+			if len(res.Errors) == 0 {
+				t.Errorf("expected the broken metric's result to include the error")
+			}
+			continue
+		}
+		if res.WindowCount != 3 {
+			t.Errorf("metric %d: expected 3 windows, got %d", i, res.WindowCount)
+		}
+		if lastStart := store.checkpoints[MetricKey(&metrics[i])]; !lastStart.Equal(startTime.Add(3 * Interval)) {
+			t.Errorf("metric %d: expected the checkpoint to move forward, got %v", i, lastStart)
+		}
+	}
+	if samples != 19*3 {
+		t.Errorf("expected %d samples, got %d", 19*3, samples)
+	}
+	if getter.max > 4 {
+		t.Errorf("expected at most 4 metrics to be processed at once, got %d", getter.max)
+	}
+}
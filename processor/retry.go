@@ -0,0 +1,91 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+)
+
+// RetryPolicy controls how calls to the getter, putter and store are retried when they fail with
+// a transient error, such as throttling. The AWS clients that the processor uses should make a
+// single attempt, e.g. with awsconfig.Settings.RetryMaxAttempts, otherwise each retry of the
+// policy is multiplied by the SDK's own retries.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first. Values less than 2 disable retries.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry. The delay doubles on each subsequent retry.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between retries.
+	MaxDelay time.Duration
+	// Jitter is the fraction of each delay that is randomised, from 0 (no jitter) to 1 (full jitter).
+	Jitter float64
+	// Retryable returns true if the error is transient and the call should be retried.
+	Retryable func(err error) bool
+}
+
+// DefaultRetryPolicy rides out short bursts of throttling, while leaving enough time in a scheduled
+// run to make progress.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   200 * time.Millisecond,
+	MaxDelay:    5 * time.Second,
+	Jitter:      0.5,
+	Retryable:   IsRetryable,
+}
+
+// NoRetryPolicy fails on the first error.
+var NoRetryPolicy = RetryPolicy{
+	MaxAttempts: 1,
+}
+
+// IsRetryable classifies throttling, timeouts, connection errors and 5xx responses from AWS as
+// retryable. Cancellation, deadlines, checkpoint conflicts and all other errors are fatal.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrCheckpointConflict) {
+		return false
+	}
+	return retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err).Bool()
+}
+
+// WithRetryPolicy sets the retry policy used for calls to the getter, putter and store. Defaults to DefaultRetryPolicy.
+func WithRetryPolicy(rp RetryPolicy) OptionsFunc {
+	return func(p *Processor) {
+		p.retryPolicy = rp
+	}
+}
+
+// delay returns the backoff before the nth retry, where 1 is the first retry.
+func (rp RetryPolicy) delay(n int) time.Duration {
+	d := rp.BaseDelay
+	for i := 1; i < n && d < rp.MaxDelay; i++ {
+		d *= 2
+	}
+	if rp.MaxDelay > 0 && d > rp.MaxDelay {
+		d = rp.MaxDelay
+	}
+	if rp.Jitter > 0 {
+		d -= time.Duration(rp.Jitter * rand.Float64() * float64(d))
+	}
+	return d
+}
+
+// do calls f until it succeeds, returns a fatal error, or runs out of attempts. onRetry is called
+// with each error that is about to be retried.
+func (rp RetryPolicy) do(ctx context.Context, onRetry func(attempt int, err error, delay time.Duration), f func() error) (err error) {
+	for attempt := 1; ; attempt++ {
+		err = f()
+		if err == nil || attempt >= rp.MaxAttempts || rp.Retryable == nil || !rp.Retryable(err) {
+			return err
+		}
+		delay := rp.delay(attempt)
+		onRetry(attempt, err, delay)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/a-h/cwexport/cw"
+	"github.com/aws/smithy-go"
+	"go.uber.org/zap"
+)
+
+var errThrottled = &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}
+
+func TestIsRetryable(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		err      error
+		expected bool
+	}{
+		{
+			desc:     "Throttling errors are retryable",
+			err:      errThrottled,
+			expected: true,
+		},
+		{
+			desc:     "Wrapped throttling errors are retryable",
+			err:      fmt.Errorf("failed to get metrics: %w", errThrottled),
+			expected: true,
+		},
+		{
+			desc:     "DynamoDB throughput errors are retryable",
+			err:      &smithy.GenericAPIError{Code: "ProvisionedThroughputExceededException"},
+			expected: true,
+		},
+		{
+			desc:     "Validation errors are fatal",
+			err:      &smithy.GenericAPIError{Code: "ValidationException"},
+			expected: false,
+		},
+		{
+			desc:     "Cancellation is fatal",
+			err:      fmt.Errorf("failed to get metrics: %w", context.Canceled),
+			expected: false,
+		},
+		{
+			desc:     "Unknown errors are fatal",
+			err:      errors.New("unknown"),
+			expected: false,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			if actual := IsRetryable(tC.err); actual != tC.expected {
+				t.Errorf("expected %v, got %v", tC.expected, actual)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	rp := RetryPolicy{
+		BaseDelay: 100 * time.Millisecond,
+		MaxDelay:  time.Second,
+		Jitter:    0.5,
+	}
+	for n, max := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 400 * time.Millisecond, 10: time.Second} {
+		for i := 0; i < 100; i++ {
+			d := rp.delay(n)
+			if d > max || d < max/2 {
+				t.Fatalf("retry %d: expected delay between %v and %v, got %v", n, max/2, max, d)
+			}
+		}
+	}
+}
+
+func TestProcessRetries(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	rp := RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Millisecond,
+		MaxDelay:    time.Millisecond,
+		Retryable:   IsRetryable,
+	}
+	startTime := time.Now().Add(-2 * Interval).Truncate(Interval)
+
+	t.Run("transient errors are retried", func(t *testing.T) {
+		var attempts int
+		metricPutter := func(ctx context.Context, ms []MetricSample) error {
+			attempts++
+			if attempts == 1 {
+				return errThrottled
+			}
+			return nil
+		}
+		store := mockMetricStore{}
+		testProcessor, _ := New(logger, &store, metricPutter, &mockCloudwatch{}, WithRetryPolicy(rp))
+		res, err := testProcessor.Process(context.Background(), startTime, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if res.WindowCount != 2 {
+			t.Errorf("expected 2 windows, got %d", res.WindowCount)
+		}
+		if len(res.Errors) != 1 {
+			t.Errorf("expected the retried error to be recorded, got %v", res.Errors)
+		}
+	})
+	t.Run("processing stops when attempts run out", func(t *testing.T) {
+		var attempts int
+		metricPutter := func(ctx context.Context, ms []MetricSample) error {
+			attempts++
+			return errThrottled
+		}
+		store := mockMetricStore{}
+		testProcessor, _ := New(logger, &store, metricPutter, &mockCloudwatch{}, WithRetryPolicy(rp))
+		res, err := testProcessor.Process(context.Background(), startTime, nil)
+		if !errors.Is(err, errThrottled) {
+			t.Fatalf("expected throttling error, got %v", err)
+		}
+		if attempts != 3 {
+			t.Errorf("expected 3 attempts, got %d", attempts)
+		}
+		if res.WindowCount != 0 {
+			t.Errorf("expected no windows to complete, got %d", res.WindowCount)
+		}
+	})
+	t.Run("only the failed samples of a partial put are retried", func(t *testing.T) {
+		samples := []cw.Sample{{Value: 1}, {Value: 2}, {Value: 3}}
+		var puts [][]MetricSample
+		metricPutter := func(ctx context.Context, ms []MetricSample) error {
+			puts = append(puts, ms)
+			if len(puts) == 1 {
+				return &PartialPutError{Failed: ms[1:2], Err: errThrottled}
+			}
+			return nil
+		}
+		store := mockMetricStore{}
+		testProcessor, _ := New(logger, &store, metricPutter, &mockCloudwatch{samples: samples}, WithRetryPolicy(rp))
+		res, err := testProcessor.Process(context.Background(), startTime, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if res.WindowCount != 2 {
+			t.Errorf("expected 2 windows, got %d", res.WindowCount)
+		}
+		if len(puts) != 3 {
+			t.Fatalf("expected a retry and a put for the second window, got %d puts", len(puts))
+		}
+		if len(puts[1]) != 1 || puts[1][0].Sample.Value != 2 {
+			t.Errorf("expected only the failed sample to be retried, got %v", puts[1])
+		}
+		if len(puts[2]) != 3 {
+			t.Errorf("expected all the samples of the next window to be put, got %d", len(puts[2]))
+		}
+	})
+	t.Run("fatal errors are not retried", func(t *testing.T) {
+		var attempts int
+		metricPutter := func(ctx context.Context, ms []MetricSample) error {
+			attempts++
+			return errors.New("fatal")
+		}
+		store := mockMetricStore{}
+		testProcessor, _ := New(logger, &store, metricPutter, &mockCloudwatch{}, WithRetryPolicy(rp))
+		_, err := testProcessor.Process(context.Background(), startTime, nil)
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if attempts != 1 {
+			t.Errorf("expected 1 attempt, got %d", attempts)
+		}
+	})
+}
@@ -0,0 +1,37 @@
+package processor
+
+import (
+	"github.com/a-h/cwexport/cw"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// WithSource sets where the processor's getter reads metrics from. Metrics from a source other than
+// the default account and region are checkpointed under keys prefixed by the source's key, so that
+// the same metric can be exported from many accounts and regions into one store. Exported samples
+// record the source's account and region.
+func WithSource(s cw.Source) OptionsFunc {
+	return func(p *Processor) {
+		p.source = s
+	}
+}
+
+// ScopedMetric returns the metric as it's identified in stores, with the source's key prefixed to
+// its namespace, e.g. "123456789012/eu-west-1/AWS/Lambda". The metric is returned unchanged for the
+// default source.
+func ScopedMetric(s cw.Source, m *types.MetricStat) *types.MetricStat {
+	key := s.Key()
+	if key == "" {
+		return m
+	}
+	scoped := *m
+	metric := *m.Metric
+	metric.Namespace = aws.String(key + "/" + aws.ToString(m.Metric.Namespace))
+	scoped.Metric = &metric
+	return &scoped
+}
+
+// SourceMetricKey returns the key of the metric read from the source, see MetricKey and ScopedMetric.
+func SourceMetricKey(s cw.Source, m *types.MetricStat) string {
+	return MetricKey(ScopedMetric(s, m))
+}
@@ -0,0 +1,88 @@
+package processor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/a-h/cwexport/cw"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"go.uber.org/zap"
+)
+
+func TestSourceMetricKey(t *testing.T) {
+	m := &types.MetricStat{
+		Metric: &types.Metric{
+			Namespace:  aws.String("AWS/Lambda"),
+			MetricName: aws.String("Invocations"),
+		},
+		Stat:   aws.String("Sum"),
+		Period: aws.Int32(60),
+	}
+	tests := []struct {
+		source   cw.Source
+		expected string
+	}{
+		{expected: "AWS/Lambda/Invocations/Sum/60"},
+		{source: cw.Source{Region: "eu-west-1"}, expected: "eu-west-1/AWS/Lambda/Invocations/Sum/60"},
+		{source: cw.Source{RoleArn: "arn:aws:iam::123456789012:role/cwexport", Region: "eu-west-1"}, expected: "123456789012/eu-west-1/AWS/Lambda/Invocations/Sum/60"},
+		{source: cw.Source{AccountId: "210987654321"}, expected: "210987654321/AWS/Lambda/Invocations/Sum/60"},
+	}
+	for _, test := range tests {
+		if actual := SourceMetricKey(test.source, m); actual != test.expected {
+			t.Errorf("%+v: expected %q, got %q", test.source, test.expected, actual)
+		}
+	}
+	if *m.Metric.Namespace != "AWS/Lambda" {
+		t.Errorf("expected the metric not to be modified, got namespace %q", *m.Metric.Namespace)
+	}
+}
+
+type keyedMetricStore struct {
+	positions map[string]time.Time
+}
+
+func (s *keyedMetricStore) Get(ctx context.Context, m *types.MetricStat) (lastStart time.Time, ok bool, err error) {
+	lastStart, ok = s.positions[MetricKey(m)]
+	return
+}
+
+func (s *keyedMetricStore) Put(ctx context.Context, m *types.MetricStat, lastStart time.Time) (err error) {
+	s.positions[MetricKey(m)] = lastStart
+	return
+}
+
+func TestProcessSource(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	m := &types.MetricStat{
+		Metric: &types.Metric{
+			Namespace:  aws.String("AWS/Lambda"),
+			MetricName: aws.String("Invocations"),
+		},
+		Stat:   aws.String("Sum"),
+		Period: aws.Int32(60),
+	}
+	source := cw.Source{AccountId: "123456789012", Region: "eu-west-1"}
+	var samples []MetricSample
+	metricPutter := func(ctx context.Context, ms []MetricSample) error {
+		samples = append(samples, ms...)
+		return nil
+	}
+	store := &keyedMetricStore{positions: map[string]time.Time{}}
+	getter := &mockCloudwatch{samples: []cw.Sample{{Value: 1}}}
+	testProcessor, _ := New(logger, store, metricPutter, getter, WithSource(source))
+	startTime := time.Now().Add(-2 * Interval).Truncate(Interval)
+	if _, err := testProcessor.Process(context.Background(), startTime, m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := store.positions["123456789012/eu-west-1/AWS/Lambda/Invocations/Sum/60"]; !ok {
+		t.Errorf("expected the checkpoint to be keyed by the source, got %v", store.positions)
+	}
+	if len(samples) != 2 {
+		t.Fatalf("expected 2 samples, got %d", len(samples))
+	}
+	if s := samples[0]; s.Account != "123456789012" || s.Region != "eu-west-1" || *s.Metric.Namespace != "AWS/Lambda" {
+		t.Errorf("expected the sample to record the source, and the metric's own namespace, got %+v", s)
+	}
+}
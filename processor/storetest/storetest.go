@@ -0,0 +1,263 @@
+// Package storetest is a conformance test suite for processor.MetricStore implementations.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/a-h/cwexport/processor"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+func newMetricStat(name string, dimensions ...types.Dimension) *types.MetricStat {
+	return &types.MetricStat{
+		Metric: &types.Metric{
+			Namespace:  aws.String("ns"),
+			MetricName: aws.String(name),
+			Dimensions: dimensions,
+		},
+		Period: aws.Int32(60),
+		Stat:   aws.String("Sum"),
+	}
+}
+
+// Run tests that the store behaves as the processor expects. newStore must return an empty store.
+// If the store implements processor.Leaser or processor.CheckpointEditor, its leases or checkpoint
+// editing are tested too.
+func Run(t *testing.T, newStore func(t *testing.T) processor.MetricStore) {
+	t.Run("checkpoints", func(t *testing.T) {
+		testCheckpoints(t, newStore(t))
+	})
+	t.Run("leases", func(t *testing.T) {
+		store := newStore(t)
+		leaser, ok := store.(processor.Leaser)
+		if !ok {
+			t.Skip("store does not implement processor.Leaser")
+		}
+		testLeases(t, leaser)
+	})
+	t.Run("checkpoint editing", func(t *testing.T) {
+		store := newStore(t)
+		editor, ok := store.(processor.CheckpointEditor)
+		if !ok {
+			t.Skip("store does not implement processor.CheckpointEditor")
+		}
+		testCheckpointEditor(t, store, editor)
+	})
+}
+
+func testCheckpoints(t *testing.T, store processor.MetricStore) {
+	ctx := context.Background()
+	m := newMetricStat("metricA", types.Dimension{Name: aws.String("ServiceName"), Value: aws.String("sn")})
+	other := newMetricStat("metricA", types.Dimension{Name: aws.String("ServiceName"), Value: aws.String("other")})
+	lastStart := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("it cannot get a checkpoint that doesn't exist", func(t *testing.T) {
+		_, ok, err := store.Get(ctx, m)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ok {
+			t.Fatal("expected ok=false, got ok=true")
+		}
+	})
+	t.Run("it can get a checkpoint that has been put", func(t *testing.T) {
+		if err := store.Put(ctx, m, lastStart); err != nil {
+			t.Fatalf("unexpected error putting checkpoint: %v", err)
+		}
+		actual, ok, err := store.Get(ctx, m)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !ok {
+			t.Fatal("expected ok=true, got ok=false")
+		}
+		if !actual.Equal(lastStart) {
+			t.Errorf("expected %v, got %v", lastStart, actual)
+		}
+	})
+	t.Run("checkpoints of metrics with different dimensions are independent", func(t *testing.T) {
+		_, ok, err := store.Get(ctx, other)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ok {
+			t.Fatal("expected ok=false, got ok=true")
+		}
+	})
+	t.Run("it can move a checkpoint forward", func(t *testing.T) {
+		lastStart = lastStart.Add(time.Minute)
+		if err := store.Put(ctx, m, lastStart); err != nil {
+			t.Fatalf("unexpected error putting checkpoint: %v", err)
+		}
+		actual, _, err := store.Get(ctx, m)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !actual.Equal(lastStart) {
+			t.Errorf("expected %v, got %v", lastStart, actual)
+		}
+	})
+	t.Run("it cannot move a checkpoint backwards", func(t *testing.T) {
+		err := store.Put(ctx, m, lastStart.Add(-time.Minute))
+		if !errors.Is(err, processor.ErrCheckpointConflict) {
+			t.Fatalf("expected processor.ErrCheckpointConflict, got %v", err)
+		}
+	})
+	t.Run("it cannot put the same checkpoint twice", func(t *testing.T) {
+		err := store.Put(ctx, m, lastStart)
+		if !errors.Is(err, processor.ErrCheckpointConflict) {
+			t.Fatalf("expected processor.ErrCheckpointConflict, got %v", err)
+		}
+	})
+	t.Run("a conflict leaves the checkpoint unchanged", func(t *testing.T) {
+		actual, _, err := store.Get(ctx, m)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !actual.Equal(lastStart) {
+			t.Errorf("expected %v, got %v", lastStart, actual)
+		}
+	})
+}
+
+func testCheckpointEditor(t *testing.T, store processor.MetricStore, editor processor.CheckpointEditor) {
+	ctx := context.Background()
+	m := newMetricStat("edited", types.Dimension{Name: aws.String("ServiceName"), Value: aws.String("sn")})
+	key := processor.MetricKey(m)
+	lastStart := time.Date(2000, time.January, 2, 0, 0, 0, 0, time.UTC)
+	// Read the checkpoint, as the processor does before it exports a window.
+	if _, _, err := store.Get(ctx, m); err != nil {
+		t.Fatalf("unexpected error getting checkpoint: %v", err)
+	}
+	if err := store.Put(ctx, m, lastStart); err != nil {
+		t.Fatalf("unexpected error putting checkpoint: %v", err)
+	}
+
+	t.Run("it can list checkpoints", func(t *testing.T) {
+		cps, err := editor.ListCheckpoints(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error listing checkpoints: %v", err)
+		}
+		if len(cps) != 1 {
+			t.Fatalf("expected 1 checkpoint, got %v", cps)
+		}
+		if cps[0].Key != key || !cps[0].LastStart.Equal(lastStart) || cps[0].Version != 1 {
+			t.Errorf("unexpected checkpoint %v", cps[0])
+		}
+	})
+	t.Run("it cannot get a checkpoint that doesn't exist", func(t *testing.T) {
+		_, ok, err := editor.GetCheckpoint(ctx, processor.MetricKey(newMetricStat("missing")))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ok {
+			t.Fatal("expected ok=false, got ok=true")
+		}
+	})
+	t.Run("it cannot set a checkpoint that has been modified", func(t *testing.T) {
+		_, err := editor.SetCheckpoint(ctx, key, lastStart.Add(-time.Hour), 0)
+		if !errors.Is(err, processor.ErrCheckpointConflict) {
+			t.Fatalf("expected processor.ErrCheckpointConflict, got %v", err)
+		}
+	})
+	t.Run("it can set a checkpoint backwards", func(t *testing.T) {
+		cp, err := editor.SetCheckpoint(ctx, key, lastStart.Add(-time.Hour), 1)
+		if err != nil {
+			t.Fatalf("unexpected error setting checkpoint: %v", err)
+		}
+		if cp.Key != key || !cp.LastStart.Equal(lastStart.Add(-time.Hour)) || cp.Version != 2 {
+			t.Errorf("unexpected checkpoint %v", cp)
+		}
+		actual, ok, err := editor.GetCheckpoint(ctx, key)
+		if err != nil {
+			t.Fatalf("unexpected error getting checkpoint: %v", err)
+		}
+		if !ok || actual != cp {
+			t.Errorf("expected %v, got %v", cp, actual)
+		}
+	})
+	t.Run("a put fails if the checkpoint was set since it was read", func(t *testing.T) {
+		err := store.Put(ctx, m, lastStart.Add(time.Minute))
+		if !errors.Is(err, processor.ErrCheckpointConflict) {
+			t.Fatalf("expected processor.ErrCheckpointConflict, got %v", err)
+		}
+		actual, _, err := store.Get(ctx, m)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !actual.Equal(lastStart.Add(-time.Hour)) {
+			t.Errorf("expected the checkpoint that was set to be kept, got %v", actual)
+		}
+	})
+	t.Run("a put succeeds once the checkpoint has been read again", func(t *testing.T) {
+		if err := store.Put(ctx, m, lastStart.Add(time.Minute)); err != nil {
+			t.Fatalf("unexpected error putting checkpoint: %v", err)
+		}
+	})
+	t.Run("it can set a checkpoint that doesn't exist", func(t *testing.T) {
+		cp, err := editor.SetCheckpoint(ctx, processor.MetricKey(newMetricStat("new")), lastStart, 0)
+		if err != nil {
+			t.Fatalf("unexpected error setting checkpoint: %v", err)
+		}
+		if cp.Version != 1 {
+			t.Errorf("expected version 1, got %d", cp.Version)
+		}
+	})
+	t.Run("it can delete a checkpoint", func(t *testing.T) {
+		if err := editor.DeleteCheckpoint(ctx, key); err != nil {
+			t.Fatalf("unexpected error deleting checkpoint: %v", err)
+		}
+		_, ok, err := editor.GetCheckpoint(ctx, key)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ok {
+			t.Fatal("expected the checkpoint to be deleted")
+		}
+	})
+}
+
+func testLeases(t *testing.T, leaser processor.Leaser) {
+	ctx := context.Background()
+	m := newMetricStat("leased")
+	acquire := func(t *testing.T, owner string, expires time.Time, expected bool) {
+		t.Helper()
+		ok, err := leaser.AcquireLease(ctx, m, owner, expires)
+		if err != nil {
+			t.Fatalf("unexpected error acquiring lease: %v", err)
+		}
+		if ok != expected {
+			t.Fatalf("expected ok=%v, got ok=%v", expected, ok)
+		}
+	}
+	release := func(t *testing.T, owner string) {
+		t.Helper()
+		if err := leaser.ReleaseLease(ctx, m, owner); err != nil {
+			t.Fatalf("unexpected error releasing lease: %v", err)
+		}
+	}
+	t.Run("it can acquire a lease that isn't held", func(t *testing.T) {
+		acquire(t, "a", time.Now().Add(time.Minute), true)
+	})
+	t.Run("the owner can extend its lease", func(t *testing.T) {
+		acquire(t, "a", time.Now().Add(2*time.Minute), true)
+	})
+	t.Run("it cannot acquire a lease held by another owner", func(t *testing.T) {
+		acquire(t, "b", time.Now().Add(time.Minute), false)
+	})
+	t.Run("releasing another owner's lease leaves it in place", func(t *testing.T) {
+		release(t, "b")
+		acquire(t, "b", time.Now().Add(time.Minute), false)
+	})
+	t.Run("it can acquire a lease once it's released", func(t *testing.T) {
+		release(t, "a")
+		acquire(t, "b", time.Now().Add(-time.Second), true)
+	})
+	t.Run("it can acquire an expired lease", func(t *testing.T) {
+		acquire(t, "a", time.Now().Add(time.Minute), true)
+	})
+}
@@ -0,0 +1,208 @@
+package replaycmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/a-h/cwexport/awsconfig"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// visibilityTimeout hides a message from other consumers while its event is replayed. It's the
+// maximum Lambda function timeout, so that a message isn't received again while it's in progress.
+const visibilityTimeout = 15 * 60
+
+type Args struct {
+	// QueueURL is the dead-letter queue, see the CWDeadLetterQueueUrl stack output.
+	QueueURL string
+	// AWS configures the profile, region and endpoints of the AWS clients.
+	AWS awsconfig.Settings
+	// Max is the maximum number of events to replay, or zero to replay every event in the queue.
+	Max int
+	// DryRun prints the events that would be replayed, without replaying them.
+	DryRun  bool
+	writer  io.Writer
+	queue   queue
+	invoker invoker
+}
+
+type queue interface {
+	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error)
+	ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error)
+}
+
+type invoker interface {
+	Invoke(ctx context.Context, params *lambda.InvokeInput, optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error)
+}
+
+// failedEvent is an event that a processor function failed to process.
+type failedEvent struct {
+	// FunctionARN is the processor function that the event was sent to.
+	FunctionARN string
+	// Payload is the event.
+	Payload json.RawMessage
+	// Reason describes why the event failed.
+	Reason string
+}
+
+// destinationRecord is the message that Lambda sends to an on-failure destination.
+type destinationRecord struct {
+	RequestContext struct {
+		FunctionARN string `json:"functionArn"`
+		Condition   string `json:"condition"`
+	} `json:"requestContext"`
+	RequestPayload  json.RawMessage `json:"requestPayload"`
+	ResponsePayload struct {
+		ErrorMessage string `json:"errorMessage"`
+	} `json:"responsePayload"`
+}
+
+var errUnknownMessage = errors.New("not an EventBridge or Lambda failure message")
+
+// parseMessage reads a message sent to the dead-letter queue by EventBridge, because it couldn't
+// invoke the function, or by Lambda, because the function failed.
+func parseMessage(m types.Message) (e failedEvent, err error) {
+	body := aws.ToString(m.Body)
+	// EventBridge sends the event as the body, and describes the failure in attributes.
+	if target, ok := m.MessageAttributes["TARGET_ARN"]; ok {
+		e.FunctionARN = aws.ToString(target.StringValue)
+		e.Payload = json.RawMessage(body)
+		e.Reason = attribute(m, "ERROR_CODE") + ": " + attribute(m, "ERROR_MESSAGE")
+		return
+	}
+	var r destinationRecord
+	if err = json.Unmarshal([]byte(body), &r); err != nil {
+		return e, fmt.Errorf("%w: %v", errUnknownMessage, err)
+	}
+	if r.RequestContext.FunctionARN == "" || len(r.RequestPayload) == 0 {
+		return e, errUnknownMessage
+	}
+	e.FunctionARN = r.RequestContext.FunctionARN
+	e.Payload = r.RequestPayload
+	e.Reason = r.RequestContext.Condition
+	if r.ResponsePayload.ErrorMessage != "" {
+		e.Reason += ": " + r.ResponsePayload.ErrorMessage
+	}
+	return
+}
+
+func attribute(m types.Message, name string) string {
+	if v, ok := m.MessageAttributes[name]; ok {
+		return aws.ToString(v.StringValue)
+	}
+	return ""
+}
+
+// Run replays the events in the dead-letter queue, by invoking the function that each event was
+// sent to, and deletes each event that is processed successfully. Events that fail again are left
+// in the queue.
+func Run(ctx context.Context, args Args) (err error) {
+	if args.writer == nil {
+		args.writer = os.Stdout
+	}
+	if args.queue == nil || args.invoker == nil {
+		cfg, err := args.AWS.Load(ctx)
+		if err != nil {
+			return fmt.Errorf("cannot load AWS config: %w", err)
+		}
+		if args.queue == nil {
+			args.queue = sqs.NewFromConfig(cfg)
+		}
+		if args.invoker == nil {
+			args.invoker = lambda.NewFromConfig(cfg)
+		}
+	}
+
+	// Messages that aren't deleted are made visible again once the run is complete, so that
+	// they can be replayed by the next run, but aren't received twice by this one.
+	var remaining []*string
+	defer func() {
+		for _, receiptHandle := range remaining {
+			_, verr := args.queue.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+				QueueUrl:          aws.String(args.QueueURL),
+				ReceiptHandle:     receiptHandle,
+				VisibilityTimeout: 0,
+			})
+			if verr != nil && err == nil {
+				err = fmt.Errorf("failed to return message to the queue: %w", verr)
+			}
+		}
+	}()
+
+	var replayed, failed int
+	for args.Max == 0 || replayed+failed < args.Max {
+		out, err := args.queue.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(args.QueueURL),
+			MaxNumberOfMessages:   1,
+			MessageAttributeNames: []string{"All"},
+			VisibilityTimeout:     visibilityTimeout,
+			WaitTimeSeconds:       1,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to receive messages: %w", err)
+		}
+		if len(out.Messages) == 0 {
+			break
+		}
+		m := out.Messages[0]
+		e, err := parseMessage(m)
+		if err != nil {
+			fmt.Fprintf(args.writer, "%s: skipped: %v\n", aws.ToString(m.MessageId), err)
+			remaining = append(remaining, m.ReceiptHandle)
+			failed++
+			continue
+		}
+		fmt.Fprintf(args.writer, "%s: %s %s (%s)\n", aws.ToString(m.MessageId), e.FunctionARN, e.Payload, e.Reason)
+		if args.DryRun {
+			remaining = append(remaining, m.ReceiptHandle)
+			replayed++
+			continue
+		}
+		if err = invoke(ctx, args.invoker, e); err != nil {
+			fmt.Fprintf(args.writer, "%s: failed: %v\n", aws.ToString(m.MessageId), err)
+			remaining = append(remaining, m.ReceiptHandle)
+			failed++
+			continue
+		}
+		_, err = args.queue.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+			QueueUrl:      aws.String(args.QueueURL),
+			ReceiptHandle: m.ReceiptHandle,
+		})
+		if err != nil {
+			return fmt.Errorf("replayed %s, but failed to delete it: %w", aws.ToString(m.MessageId), err)
+		}
+		replayed++
+	}
+	if args.DryRun {
+		fmt.Fprintf(args.writer, "%d events would be replayed, %d skipped\n", replayed, failed)
+		return nil
+	}
+	fmt.Fprintf(args.writer, "%d events replayed, %d failed\n", replayed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d events failed to replay, and remain in the queue", failed)
+	}
+	return nil
+}
+
+// invoke calls the function with the event, and waits for it to complete.
+func invoke(ctx context.Context, client invoker, e failedEvent) error {
+	out, err := client.Invoke(ctx, &lambda.InvokeInput{
+		FunctionName: aws.String(e.FunctionARN),
+		Payload:      e.Payload,
+	})
+	if err != nil {
+		return err
+	}
+	if out.FunctionError != nil {
+		return fmt.Errorf("%s: %s", aws.ToString(out.FunctionError), out.Payload)
+	}
+	return nil
+}
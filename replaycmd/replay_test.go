@@ -0,0 +1,176 @@
+package replaycmd
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const functionARN = "arn:aws:lambda:eu-west-1:123456789012:function:cwexport-Processor"
+
+func eventBridgeMessage(id, body string) types.Message {
+	return types.Message{
+		MessageId:     aws.String(id),
+		ReceiptHandle: aws.String(id),
+		Body:          aws.String(body),
+		MessageAttributes: map[string]types.MessageAttributeValue{
+			"TARGET_ARN":    {DataType: aws.String("String"), StringValue: aws.String(functionARN)},
+			"ERROR_CODE":    {DataType: aws.String("String"), StringValue: aws.String("SDK_CLIENT_ERROR")},
+			"ERROR_MESSAGE": {DataType: aws.String("String"), StringValue: aws.String("Rate Exceeded.")},
+		},
+	}
+}
+
+func lambdaMessage(id string) types.Message {
+	return types.Message{
+		MessageId:     aws.String(id),
+		ReceiptHandle: aws.String(id),
+		Body: aws.String(`{
+			"requestContext": {"functionArn": "` + functionARN + `:$LATEST", "condition": "RetriesExhausted"},
+			"requestPayload": {"Metric": {"Namespace": "AWS/Lambda"}},
+			"responsePayload": {"errorMessage": "timed out"}
+		}`),
+	}
+}
+
+type mockQueue struct {
+	messages []types.Message
+	// hidden are the receipt handles of received messages that haven't been returned or deleted.
+	hidden  map[string]bool
+	deleted []string
+}
+
+func (q *mockQueue) ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	for _, m := range q.messages {
+		if !q.hidden[*m.ReceiptHandle] {
+			q.hidden[*m.ReceiptHandle] = true
+			return &sqs.ReceiveMessageOutput{Messages: []types.Message{m}}, nil
+		}
+	}
+	return &sqs.ReceiveMessageOutput{}, nil
+}
+
+func (q *mockQueue) DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	for i, m := range q.messages {
+		if *m.ReceiptHandle == *params.ReceiptHandle {
+			q.messages = append(q.messages[:i], q.messages[i+1:]...)
+			q.deleted = append(q.deleted, *m.MessageId)
+			break
+		}
+	}
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (q *mockQueue) ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error) {
+	delete(q.hidden, *params.ReceiptHandle)
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+type mockInvoker struct {
+	invoked []string
+	// fail makes invocations with payloads that contain the string fail.
+	fail string
+}
+
+func (i *mockInvoker) Invoke(ctx context.Context, params *lambda.InvokeInput, optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error) {
+	i.invoked = append(i.invoked, *params.FunctionName+" "+string(params.Payload))
+	if i.fail != "" && strings.Contains(string(params.Payload), i.fail) {
+		return &lambda.InvokeOutput{FunctionError: aws.String("Unhandled"), Payload: []byte(`{"errorMessage":"failed again"}`)}, nil
+	}
+	return &lambda.InvokeOutput{}, nil
+}
+
+func TestParseMessage(t *testing.T) {
+	e, err := parseMessage(eventBridgeMessage("1", `{"Stat":"Sum"}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e.FunctionARN != functionARN || string(e.Payload) != `{"Stat":"Sum"}` || e.Reason != "SDK_CLIENT_ERROR: Rate Exceeded." {
+		t.Errorf("unexpected EventBridge event %+v", e)
+	}
+
+	e, err = parseMessage(lambdaMessage("2"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e.FunctionARN != functionARN+":$LATEST" || string(e.Payload) != `{"Metric": {"Namespace": "AWS/Lambda"}}` || e.Reason != "RetriesExhausted: timed out" {
+		t.Errorf("unexpected Lambda event %+v", e)
+	}
+
+	for _, body := range []string{"not json", `{"requestContext":{}}`} {
+		if _, err = parseMessage(types.Message{Body: aws.String(body)}); err == nil {
+			t.Errorf("%q: expected an error", body)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		args            Args
+		fail            string
+		expectedInvokes int
+		expectedDeleted int
+		expectedErr     bool
+	}{
+		{
+			desc:            "events are replayed and deleted",
+			expectedInvokes: 3,
+			expectedDeleted: 3,
+		},
+		{
+			desc:            "events that fail again are left in the queue",
+			fail:            "retry",
+			expectedInvokes: 3,
+			expectedDeleted: 2,
+			expectedErr:     true,
+		},
+		{
+			desc: "dry run doesn't replay",
+			args: Args{DryRun: true},
+		},
+		{
+			desc:            "max limits the events replayed",
+			args:            Args{Max: 2},
+			expectedInvokes: 2,
+			expectedDeleted: 2,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			q := &mockQueue{
+				messages: []types.Message{
+					eventBridgeMessage("1", `{"Stat":"Sum"}`),
+					eventBridgeMessage("2", `{"Stat":"retry"}`),
+					lambdaMessage("3"),
+				},
+				hidden: map[string]bool{},
+			}
+			inv := &mockInvoker{fail: tc.fail}
+			var w strings.Builder
+			args := tc.args
+			args.QueueURL = "https://sqs.eu-west-1.amazonaws.com/123456789012/cwexport-DeadLetterQueue"
+			args.writer = &w
+			args.queue = q
+			args.invoker = inv
+			err := Run(context.Background(), args)
+			if (err != nil) != tc.expectedErr {
+				t.Errorf("expected error %v, got %v", tc.expectedErr, err)
+			}
+			if len(inv.invoked) != tc.expectedInvokes {
+				t.Errorf("expected %d invocations, got %v", tc.expectedInvokes, inv.invoked)
+			}
+			if len(q.deleted) != tc.expectedDeleted {
+				t.Errorf("expected %d deleted messages, got %v", tc.expectedDeleted, q.deleted)
+			}
+			if len(q.hidden) != len(q.deleted) {
+				t.Errorf("expected messages that weren't deleted to be returned to the queue, got %d hidden\n%s", len(q.hidden), w.String())
+			}
+		})
+	}
+}
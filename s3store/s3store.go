@@ -0,0 +1,306 @@
+// Package s3store stores checkpoints and leases as small JSON objects in S3, using ETag-conditional
+// writes so that concurrent processors can't overwrite each other.
+package s3store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/a-h/cwexport/processor"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// Open creates a store from a URL in the form s3://bucket/prefix. The optFns can be used to override
+// the client options, e.g. to set an endpoint.
+func Open(config aws.Config, url string, optFns ...func(*s3.Options)) (s *MetricStore, err error) {
+	if !strings.HasPrefix(url, "s3://") {
+		return nil, fmt.Errorf("s3store: unsupported URL %q, expected s3://bucket/prefix", url)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(url, "s3://"), "/", 2)
+	bucket, prefix := parts[0], ""
+	if len(parts) > 1 {
+		prefix = parts[1]
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("s3store: missing bucket name in URL %q", url)
+	}
+	return NewFromConfig(config, bucket, strings.Trim(prefix, "/"), optFns...), nil
+}
+
+// New creates a store that keeps objects in the bucket, under the prefix.
+func New(client *s3.Client, bucket, prefix string) *MetricStore {
+	return &MetricStore{
+		client:   client,
+		bucket:   bucket,
+		prefix:   prefix,
+		versions: &processor.CheckpointVersions{},
+	}
+}
+
+// NewFromConfig creates a store from AWS config. The optFns can be used to override the client
+// options, e.g. to set an endpoint resolver.
+func NewFromConfig(config aws.Config, bucket, prefix string, optFns ...func(*s3.Options)) *MetricStore {
+	return New(s3.NewFromConfig(config, optFns...), bucket, prefix)
+}
+
+type MetricStore struct {
+	client *s3.Client
+	bucket string
+	prefix string
+	// versions are the checkpoint versions read by Get.
+	versions *processor.CheckpointVersions
+}
+
+// <prefix>/<metric key>/checkpoint.json
+// {"lastStart":"2022-04-01T13:13:35Z","version":42}
+//
+// <prefix>/<metric key>/lease.json
+// {"owner":"3f2a...","expires":"2022-04-01T13:14:35Z"}
+
+type checkpoint struct {
+	LastStart time.Time `json:"lastStart"`
+	Version   int64     `json:"version"`
+}
+
+type lease struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// checkpointName is the name of the object that holds each metric's checkpoint.
+const checkpointName = "checkpoint.json"
+
+func (s *MetricStore) objectKey(m *types.MetricStat, name string) string {
+	return s.keyedObjectKey(processor.MetricKey(m), name)
+}
+
+func (s *MetricStore) keyedObjectKey(key, name string) string {
+	return path.Join(s.prefix, key, name)
+}
+
+// get reads the JSON object into v. If the object doesn't exist, ok is false.
+func (s *MetricStore) get(ctx context.Context, key string, v interface{}) (etag string, ok bool, err error) {
+	goo, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	})
+	var nsk *s3types.NoSuchKey
+	if errors.As(err, &nsk) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("s3store: failed to get %q: %w", key, err)
+	}
+	defer goo.Body.Close()
+	if err = json.NewDecoder(goo.Body).Decode(v); err != nil {
+		return "", false, fmt.Errorf("s3store: failed to decode %q: %w", key, err)
+	}
+	return aws.ToString(goo.ETag), true, nil
+}
+
+// errPreconditionFailed is returned when a conditional write fails because the object has changed.
+var errPreconditionFailed = errors.New("s3store: object has been modified")
+
+// put writes v as a JSON object. If etag is empty, the object must not exist, otherwise the object's
+// ETag must match.
+func (s *MetricStore) put(ctx context.Context, key, etag string, v interface{}) (err error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	condition := smithyhttp.SetHeaderValue("If-None-Match", "*")
+	if etag != "" {
+		condition = smithyhttp.SetHeaderValue("If-Match", etag)
+	}
+	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      &s.bucket,
+		Key:         &key,
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	}, s3.WithAPIOptions(condition))
+	var re *awshttp.ResponseError
+	if errors.As(err, &re) && (re.HTTPStatusCode() == http.StatusPreconditionFailed || re.HTTPStatusCode() == http.StatusConflict) {
+		return errPreconditionFailed
+	}
+	if err != nil {
+		return fmt.Errorf("s3store: failed to put %q: %w", key, err)
+	}
+	return nil
+}
+
+// Get gets the metric's checkpoint, and keeps its version so that the next Put of the metric only
+// succeeds if the checkpoint hasn't been modified since.
+func (s *MetricStore) Get(ctx context.Context, m *types.MetricStat) (lastStart time.Time, ok bool, err error) {
+	var cp checkpoint
+	_, ok, err = s.get(ctx, s.objectKey(m, checkpointName), &cp)
+	if err != nil {
+		return
+	}
+	s.versions.Set(processor.MetricKey(m), cp.Version)
+	return cp.LastStart, ok, err
+}
+
+// Put moves the metric's checkpoint forward to lastStart. If the stored checkpoint is already at or
+// beyond lastStart, has been modified since it was read by Get, or is modified during the write,
+// processor.ErrCheckpointConflict is returned.
+func (s *MetricStore) Put(ctx context.Context, m *types.MetricStat, lastStart time.Time) (err error) {
+	metricKey := processor.MetricKey(m)
+	key := s.objectKey(m, checkpointName)
+	var cp checkpoint
+	etag, ok, err := s.get(ctx, key, &cp)
+	if err != nil {
+		return err
+	}
+	if ok && !cp.LastStart.Before(lastStart) {
+		s.versions.Delete(metricKey)
+		return fmt.Errorf("%w: %s is not after the stored checkpoint", processor.ErrCheckpointConflict, lastStart.UTC().Format(time.RFC3339))
+	}
+	if expected, hasVersion := s.versions.Get(metricKey); hasVersion && cp.Version != expected {
+		s.versions.Delete(metricKey)
+		return fmt.Errorf("%w: the checkpoint has been modified since version %d", processor.ErrCheckpointConflict, expected)
+	}
+	cp.LastStart = lastStart.UTC()
+	cp.Version++
+	err = s.put(ctx, key, etag, cp)
+	if errors.Is(err, errPreconditionFailed) {
+		s.versions.Delete(metricKey)
+		return fmt.Errorf("%w: the checkpoint was modified by another processor", processor.ErrCheckpointConflict)
+	}
+	if err != nil {
+		return err
+	}
+	// Keep the new version, so that the next window can be put without reading the checkpoint again.
+	s.versions.Set(metricKey, cp.Version)
+	return nil
+}
+
+// GetCheckpoint gets the checkpoint of the metric with the given key.
+func (s *MetricStore) GetCheckpoint(ctx context.Context, key string) (cp processor.Checkpoint, ok bool, err error) {
+	var stored checkpoint
+	_, ok, err = s.get(ctx, s.keyedObjectKey(key, checkpointName), &stored)
+	if err != nil || !ok {
+		return
+	}
+	return processor.Checkpoint{Key: key, LastStart: stored.LastStart, Version: stored.Version}, true, nil
+}
+
+// ListCheckpoints lists the checkpoint objects under the prefix, and reads each of them.
+func (s *MetricStore) ListCheckpoints(ctx context.Context) (cps []processor.Checkpoint, err error) {
+	prefix := s.prefix
+	if prefix != "" {
+		prefix += "/"
+	}
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: &s.bucket,
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return cps, fmt.Errorf("s3store: failed to list checkpoints: %w", err)
+		}
+		for _, obj := range page.Contents {
+			name := strings.TrimPrefix(aws.ToString(obj.Key), prefix)
+			if !strings.HasSuffix(name, "/"+checkpointName) {
+				continue
+			}
+			cp, ok, err := s.GetCheckpoint(ctx, strings.TrimSuffix(name, "/"+checkpointName))
+			if err != nil {
+				return cps, err
+			}
+			if ok {
+				cps = append(cps, cp)
+			}
+		}
+	}
+	return
+}
+
+// SetCheckpoint sets the checkpoint of the metric with the given key, even if it moves the checkpoint
+// backwards. It's used to replay or skip data. The checkpoint must have the expected version, which
+// is 0 if it doesn't exist, otherwise processor.ErrCheckpointConflict is returned, so that a
+// checkpoint moved by a processor since it was read isn't overwritten.
+func (s *MetricStore) SetCheckpoint(ctx context.Context, key string, lastStart time.Time, expectedVersion int64) (cp processor.Checkpoint, err error) {
+	objectKey := s.keyedObjectKey(key, checkpointName)
+	var stored checkpoint
+	etag, _, err := s.get(ctx, objectKey, &stored)
+	if err != nil {
+		return
+	}
+	if stored.Version != expectedVersion {
+		err = fmt.Errorf("%w: the checkpoint has been modified since version %d", processor.ErrCheckpointConflict, expectedVersion)
+		return
+	}
+	stored.LastStart = lastStart.UTC()
+	stored.Version++
+	err = s.put(ctx, objectKey, etag, stored)
+	if errors.Is(err, errPreconditionFailed) {
+		err = fmt.Errorf("%w: the checkpoint has been modified since version %d", processor.ErrCheckpointConflict, expectedVersion)
+		return
+	}
+	if err != nil {
+		return
+	}
+	return processor.Checkpoint{Key: key, LastStart: stored.LastStart, Version: stored.Version}, nil
+}
+
+// DeleteCheckpoint deletes the checkpoint of the metric with the given key, so that the next export
+// starts from the configured start time.
+func (s *MetricStore) DeleteCheckpoint(ctx context.Context, key string) (err error) {
+	objectKey := s.keyedObjectKey(key, checkpointName)
+	_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &s.bucket,
+		Key:    &objectKey,
+	})
+	if err != nil {
+		return fmt.Errorf("s3store: failed to delete %q: %w", objectKey, err)
+	}
+	return nil
+}
+
+// AcquireLease takes the lease on the metric for the owner until it expires. If another owner holds
+// a lease that hasn't expired, or takes the lease at the same time, ok is false.
+func (s *MetricStore) AcquireLease(ctx context.Context, m *types.MetricStat, owner string, expires time.Time) (ok bool, err error) {
+	key := s.objectKey(m, "lease.json")
+	var l lease
+	etag, exists, err := s.get(ctx, key, &l)
+	if err != nil {
+		return false, err
+	}
+	if exists && l.Owner != owner && l.Expires.After(time.Now()) {
+		return false, nil
+	}
+	err = s.put(ctx, key, etag, lease{Owner: owner, Expires: expires.UTC()})
+	if errors.Is(err, errPreconditionFailed) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ReleaseLease releases the owner's lease on the metric by expiring it. If the lease has since been
+// taken by another owner, it's left in place.
+func (s *MetricStore) ReleaseLease(ctx context.Context, m *types.MetricStat, owner string) (err error) {
+	key := s.objectKey(m, "lease.json")
+	var l lease
+	etag, exists, err := s.get(ctx, key, &l)
+	if err != nil || !exists || l.Owner != owner {
+		return err
+	}
+	err = s.put(ctx, key, etag, lease{})
+	if errors.Is(err, errPreconditionFailed) {
+		return nil
+	}
+	return err
+}
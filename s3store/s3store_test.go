@@ -0,0 +1,201 @@
+package s3store
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/a-h/cwexport/processor"
+	"github.com/a-h/cwexport/processor/storetest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// fakeS3 is an in-memory stand-in for the parts of the S3 API used by the store, including
+// conditional writes.
+type fakeS3 struct {
+	m       sync.Mutex
+	objects map[string][]byte
+	// beforePut is called before a write is applied, to simulate concurrent writers.
+	beforePut func()
+}
+
+func etag(b []byte) string {
+	return fmt.Sprintf(`"%x"`, md5.Sum(b))
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut && f.beforePut != nil {
+		beforePut := f.beforePut
+		f.beforePut = nil
+		beforePut()
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	key := r.URL.Path
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Get("list-type") == "2" {
+			f.list(w, strings.TrimPrefix(key, "/"), r.URL.Query().Get("prefix"))
+			return
+		}
+		b, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+			return
+		}
+		w.Header().Set("ETag", etag(b))
+		w.Write(b)
+	case http.MethodPut:
+		b, ok := f.objects[key]
+		if (r.Header.Get("If-None-Match") == "*" && ok) ||
+			(r.Header.Get("If-Match") != "" && (!ok || r.Header.Get("If-Match") != etag(b))) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			io.WriteString(w, `<Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold</Message></Error>`)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		f.objects[key] = body
+		w.Header().Set("ETag", etag(body))
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+type listBucketResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string
+	Prefix      string
+	KeyCount    int
+	IsTruncated bool
+	Contents    []struct{ Key string }
+}
+
+// list writes the keys of the objects in the bucket that start with the prefix, in a single page.
+func (f *fakeS3) list(w http.ResponseWriter, bucket, prefix string) {
+	res := listBucketResult{Name: bucket, Prefix: prefix}
+	for path := range f.objects {
+		if key := strings.TrimPrefix(path, "/"+bucket+"/"); strings.HasPrefix(key, prefix) {
+			res.Contents = append(res.Contents, struct{ Key string }{Key: key})
+		}
+	}
+	sort.Slice(res.Contents, func(i, j int) bool { return res.Contents[i].Key < res.Contents[j].Key })
+	res.KeyCount = len(res.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(res)
+}
+
+func newTestStore(t *testing.T) (*MetricStore, *fakeS3) {
+	f := &fakeS3{objects: map[string][]byte{}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	s := NewFromConfig(aws.Config{
+		Region:      "eu-pluto-1",
+		Credentials: credentials.NewStaticCredentialsProvider("fake", "accessKeyId", "secretKeyId"),
+		Retryer:     func() aws.Retryer { return aws.NopRetryer{} },
+	}, "bucket", "checkpoints", func(o *s3.Options) {
+		o.BaseEndpoint = aws.String(server.URL)
+		o.UsePathStyle = true
+	})
+	return s, f
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) processor.MetricStore {
+		s, _ := newTestStore(t)
+		return s
+	})
+}
+
+var testMetric = &types.MetricStat{
+	Metric: &types.Metric{
+		Namespace:  aws.String("AWS/Lambda"),
+		MetricName: aws.String("Invocations"),
+	},
+	Period: aws.Int32(60),
+	Stat:   aws.String("Sum"),
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	s, f := newTestStore(t)
+	start := time.Date(2022, time.April, 1, 13, 0, 0, 0, time.UTC)
+	if err := s.Put(ctx, testMetric, start); err != nil {
+		t.Fatalf("failed to put initial checkpoint: %v", err)
+	}
+
+	// Another processor moves the checkpoint forward between our read and write.
+	f.beforePut = func() {
+		if err := s.Put(ctx, testMetric, start.Add(2*time.Minute)); err != nil {
+			t.Errorf("concurrent put failed: %v", err)
+		}
+	}
+	err := s.Put(ctx, testMetric, start.Add(time.Minute))
+	if !errors.Is(err, processor.ErrCheckpointConflict) {
+		t.Fatalf("expected a checkpoint conflict, got %v", err)
+	}
+	lastStart, _, err := s.Get(ctx, testMetric)
+	if err != nil {
+		t.Fatalf("failed to get checkpoint: %v", err)
+	}
+	if !lastStart.Equal(start.Add(2 * time.Minute)) {
+		t.Errorf("expected the concurrent writer's checkpoint to be kept, got %v", lastStart)
+	}
+}
+
+func TestObjectKey(t *testing.T) {
+	s, f := newTestStore(t)
+	if err := s.Put(context.Background(), testMetric, time.Now()); err != nil {
+		t.Fatalf("failed to put checkpoint: %v", err)
+	}
+	expected := "/bucket/checkpoints/AWS/Lambda/Invocations/Sum/60/checkpoint.json"
+	if _, ok := f.objects[expected]; !ok {
+		t.Errorf("expected object %q, got %v", expected, f.objects)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	tests := []struct {
+		url            string
+		expectedBucket string
+		expectedPrefix string
+		expectErr      bool
+	}{
+		{url: "s3://bucket", expectedBucket: "bucket"},
+		{url: "s3://bucket/checkpoints", expectedBucket: "bucket", expectedPrefix: "checkpoints"},
+		{url: "s3://bucket/cwexport/checkpoints/", expectedBucket: "bucket", expectedPrefix: "cwexport/checkpoints"},
+		{url: "s3://", expectErr: true},
+		{url: "sqlite://checkpoints.db", expectErr: true},
+	}
+	for _, test := range tests {
+		s, err := Open(aws.Config{Region: "eu-pluto-1"}, test.url)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got nil", test.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.url, err)
+		}
+		if s.bucket != test.expectedBucket || s.prefix != test.expectedPrefix {
+			t.Errorf("%s: expected bucket %q and prefix %q, got %q and %q", test.url, test.expectedBucket, test.expectedPrefix, s.bucket, s.prefix)
+		}
+	}
+}
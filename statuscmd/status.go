@@ -0,0 +1,147 @@
+package statuscmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/a-h/cwexport/awsconfig"
+	"github.com/a-h/cwexport/db"
+	"github.com/a-h/cwexport/processor"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+type Format string
+
+const (
+	FormatTable Format = "table"
+	FormatJSON  Format = "json"
+)
+
+func IsValidFormat(f Format) bool {
+	return f == FormatTable || f == FormatJSON
+}
+
+type Args struct {
+	Stats *[]types.MetricStat
+	// TableName is the DynamoDB table that holds the checkpoints, used if Store is nil.
+	TableName string
+	// Store holds the checkpoints, instead of the DynamoDB table. The outcome of each metric's
+	// last run is only shown if the store is a processor.StatusReader.
+	Store processor.MetricStore
+	// AWS configures the profile, region and endpoints of the AWS clients.
+	AWS awsconfig.Settings
+	// StaleAfter is how far a checkpoint can lag behind now before the metric is considered stale.
+	StaleAfter time.Duration
+	Format     Format
+	writer     io.Writer
+}
+
+// MetricStatus is the export status of a single metric.
+type MetricStatus struct {
+	Key string `json:"key"`
+	// Position is the checkpoint of the metric, or nil if it has never been exported.
+	Position *time.Time `json:"position,omitempty"`
+	// Lag is how far the checkpoint is behind now.
+	Lag time.Duration `json:"lag"`
+	// Status of the metric's runs, or nil if it has never been run.
+	Status *processor.Status `json:"status,omitempty"`
+	// StatusUnavailable is true if the store doesn't keep the status of runs.
+	StatusUnavailable bool `json:"statusUnavailable,omitempty"`
+	// Stale is true if the metric has never been exported, or its lag exceeds the threshold.
+	Stale bool `json:"stale"`
+}
+
+// Outcome summarises the last run of the metric.
+func (ms MetricStatus) Outcome() string {
+	if ms.StatusUnavailable {
+		return "not recorded by the store"
+	}
+	if ms.Status == nil {
+		return "never run"
+	}
+	if ms.Status.ConsecutiveFailures > 0 {
+		return fmt.Sprintf("failed %d times: %s", ms.Status.ConsecutiveFailures, ms.Status.LastError)
+	}
+	return "ok"
+}
+
+// Run writes the status of each metric, and returns stale=true if any metric is stale.
+func Run(ctx context.Context, args Args) (stale bool, err error) {
+	if args.writer == nil {
+		args.writer = os.Stdout
+	}
+	if args.Store == nil {
+		cfg, err := args.AWS.Load(ctx)
+		if err != nil {
+			return false, fmt.Errorf("cannot load AWS config: %w", err)
+		}
+		args.Store, err = db.NewMetricStoreFromConfig(cfg, args.TableName, args.AWS.DynamoDBOptions)
+		if err != nil {
+			return false, fmt.Errorf("cannot create store: %w", err)
+		}
+	}
+	statusReader, hasStatus := args.Store.(processor.StatusReader)
+	now := time.Now()
+	statuses := make([]MetricStatus, len(*args.Stats))
+	for i := range *args.Stats {
+		m := &(*args.Stats)[i]
+		ms := MetricStatus{
+			Key:               processor.MetricKey(m),
+			Stale:             true,
+			StatusUnavailable: !hasStatus,
+		}
+		position, ok, err := args.Store.Get(ctx, m)
+		if err != nil {
+			return false, fmt.Errorf("failed to get checkpoint for %q: %w", ms.Key, err)
+		}
+		if ok {
+			ms.Position = &position
+			ms.Lag = now.Sub(position)
+			ms.Stale = ms.Lag > args.StaleAfter
+		}
+		if hasStatus {
+			status, ok, err := statusReader.GetStatus(ctx, m)
+			if err != nil {
+				return false, fmt.Errorf("failed to get status for %q: %w", ms.Key, err)
+			}
+			if ok {
+				ms.Status = &status
+			}
+		}
+		stale = stale || ms.Stale
+		statuses[i] = ms
+	}
+	switch args.Format {
+	case FormatJSON:
+		enc := json.NewEncoder(args.writer)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(statuses)
+	default:
+		err = writeTable(args.writer, statuses)
+	}
+	return stale, err
+}
+
+func writeTable(w io.Writer, statuses []MetricStatus) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "METRIC\tPOSITION\tLAG\tLAST RUN\tOUTCOME\tSTALE")
+	for _, ms := range statuses {
+		position, lag, lastRun := "-", "-", "-"
+		if ms.Position != nil {
+			position = ms.Position.Format(time.RFC3339)
+			lag = ms.Lag.Round(time.Second).String()
+		}
+		if ms.Status != nil {
+			lastRun = ms.Status.LastRun.Format(time.RFC3339)
+		}
+		outcome := strings.ReplaceAll(ms.Outcome(), "\t", " ")
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%v\n", ms.Key, position, lag, lastRun, outcome, ms.Stale)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,180 @@
+package statuscmd
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/a-h/cwexport/processor"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+type mockStatusStore struct {
+	positions map[string]time.Time
+	statuses  map[string]processor.Status
+}
+
+func (s mockStatusStore) Get(ctx context.Context, m *types.MetricStat) (lastStart time.Time, ok bool, err error) {
+	lastStart, ok = s.positions[processor.MetricKey(m)]
+	return
+}
+
+func (s mockStatusStore) Put(ctx context.Context, m *types.MetricStat, lastStart time.Time) (err error) {
+	s.positions[processor.MetricKey(m)] = lastStart
+	return
+}
+
+func (s mockStatusStore) GetStatus(ctx context.Context, m *types.MetricStat) (status processor.Status, ok bool, err error) {
+	status, ok = s.statuses[processor.MetricKey(m)]
+	return
+}
+
+func newMetricStat(name string) types.MetricStat {
+	return types.MetricStat{
+		Metric: &types.Metric{
+			Namespace:  aws.String("ns"),
+			MetricName: aws.String(name),
+		},
+		Period: aws.Int32(60),
+		Stat:   aws.String("Sum"),
+	}
+}
+
+func TestStatus(t *testing.T) {
+	now := time.Now()
+	store := mockStatusStore{
+		positions: map[string]time.Time{
+			"ns/current/Sum/60": now.Add(-5 * time.Minute),
+			"ns/behind/Sum/60":  now.Add(-time.Hour),
+		},
+		statuses: map[string]processor.Status{
+			"ns/current/Sum/60": {LastRun: now, LastSuccess: now},
+			"ns/behind/Sum/60":  {LastRun: now, LastFailure: now, LastError: "throttled", ConsecutiveFailures: 3},
+		},
+	}
+	testCases := []struct {
+		desc          string
+		stats         []types.MetricStat
+		expectedStale bool
+	}{
+		{
+			desc:          "Metrics within the threshold are not stale",
+			stats:         []types.MetricStat{newMetricStat("current")},
+			expectedStale: false,
+		},
+		{
+			desc:          "Metrics beyond the threshold are stale",
+			stats:         []types.MetricStat{newMetricStat("current"), newMetricStat("behind")},
+			expectedStale: true,
+		},
+		{
+			desc:          "Metrics that have never been exported are stale",
+			stats:         []types.MetricStat{newMetricStat("current"), newMetricStat("missing")},
+			expectedStale: true,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var w strings.Builder
+			stale, err := Run(context.Background(), Args{
+				Stats:      &tC.stats,
+				StaleAfter: 15 * time.Minute,
+				Format:     FormatJSON,
+				writer:     &w,
+				Store:      store,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if stale != tC.expectedStale {
+				t.Errorf("expected stale=%v, got %v", tC.expectedStale, stale)
+			}
+			var statuses []MetricStatus
+			if err = json.Unmarshal([]byte(w.String()), &statuses); err != nil {
+				t.Fatalf("failed to parse output: %v", err)
+			}
+			if len(statuses) != len(tC.stats) {
+				t.Errorf("expected %d statuses, got %d", len(tC.stats), len(statuses))
+			}
+		})
+	}
+}
+
+func TestStatusTable(t *testing.T) {
+	now := time.Now()
+	store := mockStatusStore{
+		positions: map[string]time.Time{
+			"ns/behind/Sum/60": now.Add(-time.Hour),
+		},
+		statuses: map[string]processor.Status{
+			"ns/behind/Sum/60": {LastRun: now, LastFailure: now, LastError: "throttled", ConsecutiveFailures: 3},
+		},
+	}
+	var w strings.Builder
+	_, err := Run(context.Background(), Args{
+		Stats:      &[]types.MetricStat{newMetricStat("behind"), newMetricStat("missing")},
+		StaleAfter: 15 * time.Minute,
+		Format:     FormatTable,
+		writer:     &w,
+		Store:      store,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(w.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected a header and 2 rows, got %q", w.String())
+	}
+	for _, expected := range []string{"ns/behind/Sum/60", "1h0m0s", "failed 3 times: throttled", "true"} {
+		if !strings.Contains(lines[1], expected) {
+			t.Errorf("expected %q in %q", expected, lines[1])
+		}
+	}
+	if !strings.Contains(lines[2], "never run") {
+		t.Errorf("expected the missing metric to have never run, got %q", lines[2])
+	}
+}
+
+// mockCheckpointStore keeps checkpoints, but not the status of runs.
+type mockCheckpointStore struct {
+	positions map[string]time.Time
+}
+
+func (s mockCheckpointStore) Get(ctx context.Context, m *types.MetricStat) (lastStart time.Time, ok bool, err error) {
+	lastStart, ok = s.positions[processor.MetricKey(m)]
+	return
+}
+
+func (s mockCheckpointStore) Put(ctx context.Context, m *types.MetricStat, lastStart time.Time) (err error) {
+	s.positions[processor.MetricKey(m)] = lastStart
+	return
+}
+
+func TestStatusWithoutRunStatus(t *testing.T) {
+	now := time.Now()
+	store := mockCheckpointStore{
+		positions: map[string]time.Time{
+			"ns/current/Sum/60": now.Add(-5 * time.Minute),
+		},
+	}
+	var w strings.Builder
+	stale, err := Run(context.Background(), Args{
+		Stats:      &[]types.MetricStat{newMetricStat("current")},
+		StaleAfter: 15 * time.Minute,
+		Format:     FormatTable,
+		writer:     &w,
+		Store:      store,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stale {
+		t.Error("expected the metric within the threshold not to be stale")
+	}
+	if !strings.Contains(w.String(), "not recorded by the store") {
+		t.Errorf("expected the outcome not to be recorded, got %q", w.String())
+	}
+}